@@ -5,44 +5,160 @@
 package sshclient
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
-// Results comprises the results from running a command via ssh
+// Results comprises the results from running a command via ssh.
+// Stdout and Stderr hold whatever output arrived, even if the command
+// didn't finish normally, e.g. as the connection dropped mid-run
 type Results struct {
-	RC     int    // the result code of the command itself
+	RC     int    // the result code of the command itself, -1 if unknown
 	Stdout string // stdout from the command
 	Stderr string // stderr from the command
+	Signal string // the signal that killed the command, e.g. "KILL"
 }
 
 type CmdError struct {
 	RC     int
 	Stdout string
 	Stderr string
+
+	// SCPLevel is the scp protocol status of a failed transfer,
+	// SCPWarning or SCPError, and SCPMessage the message sent with it.
+	// Both are unset for failures that aren't from scp
+	SCPLevel   int
+	SCPMessage string
 }
 
+// scp protocol status levels
+const (
+	SCPWarning = 1
+	SCPError   = 2
+)
+
 func (e CmdError) Error() string {
 	return fmt.Sprintf("rc:%d stdout:%q stderr:%q", e.RC, e.Stdout, e.Stderr)
 }
 
-// Connection allows for multiple commands to be run against an ssh connection
+// Unwrap makes CmdError match ErrCommandFailed
+func (e CmdError) Unwrap() error {
+	return ErrCommandFailed
+}
+
+// Connection allows for multiple commands to be run against an ssh connection.
+// Exec and the other methods that run in a session of their own are safe
+// for concurrent use; Run and the rest that share the connection's own
+// session and buffers are not
 type Connection struct {
+	conn     net.Conn
 	client   *ssh.Client
 	ssh      *ssh.Session
 	out, err bytes.Buffer
+
+	// attached is set when the client belongs to someone else,
+	// so isn't closed with the Connection
+	attached bool
+
+	// the host key the server presented in the handshake, and the
+	// address it was checked for, as reported by HostKey
+	hostKey     ssh.PublicKey
+	hostKeyAddr string
+
+	// MaxFileSize, when positive, is the largest upload Copy will send;
+	// larger files are rejected before anything is sent to the remote
+	MaxFileSize int64
+
+	// NoSFTPFallback requires Copy to use scp, even if the remote lacks it
+	NoSFTPFallback bool
+
+	// ScpCommand, if set, runs scp on the remote host in place of
+	// DefaultScpCommand, e.g. "sudo scp" or "/usr/local/bin/scp".
+	// Its flags and path are appended. Copy takes it as given,
+	// rather than checking the remote has it
+	ScpCommand string
+
+	// CopyTimeout, when positive, limits how long the transfer made by
+	// Copy may take in all. A stalled transfer is abandoned when it runs
+	// out, closing its session, with an error matching ErrTimeout
+	CopyTimeout time.Duration
+
+	// ResumeIfPresent makes Copy skip the upload when the remote file
+	// already matches, as determined by ResumeCompare
+	ResumeIfPresent bool
+	ResumeCompare   Compare
+
+	scpOnce sync.Once
+	hasSCP  bool
+
+	// how the most recent transfer went, as concurrent ones may race
+	lastMu    sync.Mutex
+	transport Transport
+	skipped   bool
+
+	// Environment holds variables to set for the commands the Connection
+	// runs, bar RunSudo's, subject to the same restrictions as SetEnv
+	Environment map[string]string
+
+	// CloseBastion links a Connection made by DialJump to its bastion,
+	// so that closing one closes both
+	CloseBastion bool
+	bastion      *Connection
+
+	// KeepaliveMaxFailures is how many keepalives in a row may fail
+	// before the connection is closed as dead (default 3)
+	KeepaliveMaxFailures int
+	kaMu                 sync.Mutex
+	kaStop               chan struct{}
+
+	// the idle timeout set by SetIdleTimeout
+	idleMu      sync.Mutex
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	idleLast    time.Time
+	idleBusy    int
+	idleClosed  bool
+	startDone   func()
+
+	closeOnce sync.Once
+	closeErr  error
+
+	// the persistent shell used by RunInShell
+	shellIn  io.WriteCloser
+	shellOut *bufio.Reader
 }
 
+// Compare selects how an existing remote file is matched against an upload
+type Compare int
+
+// Remote file comparison strategies
+const (
+	CompareSize     Compare = iota // sizes are equal
+	CompareChecksum                // sha256 sums are equal
+)
+
 // NewSesson creates a new session for the connection
 func (s *Connection) NewSession() error {
 	var err error
@@ -50,16 +166,52 @@ func (s *Connection) NewSession() error {
 	return err
 }
 
+// Client returns the underlying ssh client, for anything this package
+// doesn't cover. Closing it closes the Connection
+func (s *Connection) Client() *ssh.Client {
+	return s.client
+}
+
+// Session returns the connection's current ssh session,
+// as used by Run and replaced by NewSession
+func (s *Connection) Session() *ssh.Session {
+	return s.ssh
+}
+
 type keychain struct {
 	keys []ssh.Signer
 }
 
-// Close closes the ssh session
-func (s *Connection) Close() {
-	s.ssh.Close()
-	if s.client != nil {
-		s.client.Close()
+// Close closes the ssh session and connection, returning any errors
+// doing so, joined together. It is safe to call more than once, each
+// call returning the same, and on a Connection that was never connected
+func (s *Connection) Close() error {
+	if s == nil {
+		return nil
 	}
+	s.closeOnce.Do(func() {
+		s.StopKeepalive()
+		s.stopIdle()
+		var errs []error
+		// the session reports EOF once its command is done
+		if s.ssh != nil {
+			if err := s.ssh.Close(); err != nil && err != io.EOF {
+				errs = append(errs, fmt.Errorf("closing session: %w", err))
+			}
+		}
+		if s.client != nil && !s.attached {
+			if err := s.client.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("closing connection: %w", err))
+			}
+		}
+		if s.CloseBastion && s.bastion != nil {
+			if err := s.bastion.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("closing bastion: %w", err))
+			}
+		}
+		s.closeErr = errors.Join(errs...)
+	})
+	return s.closeErr
 }
 
 // Clear clears the stdout and stderr buffers
@@ -68,6 +220,17 @@ func (s *Connection) Clear() {
 	s.err.Reset()
 }
 
+// SetDeadline sets the read and write deadline on the underlying network
+// connection, as a last-resort guard against a hung transport.
+// Exceeding the deadline tears down the whole connection, not just the
+// operation in progress. A zero value for t means no deadline
+func (s *Connection) SetDeadline(t time.Time) error {
+	if s.conn == nil {
+		return errors.New("no network connection to set a deadline on")
+	}
+	return s.conn.SetDeadline(t)
+}
+
 // Shell opens an command shell on the remote host
 func (s *Connection) Shell() error {
 	return s.ssh.Shell()
@@ -90,6 +253,20 @@ func (k *keychain) PrivateKeyFile(file string) error {
 	return k.PrivateKey(buf)
 }
 
+// PrivateKeyWithPassphrase adds a private key that may be passphrase
+// protected. The passphrase is ignored if the key isn't encrypted
+func (k *keychain) PrivateKeyWithPassphrase(text, passphrase []byte) error {
+	key, err := ssh.ParsePrivateKey(text)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		key, err = ssh.ParsePrivateKeyWithPassphrase(text, passphrase)
+	}
+	if err != nil {
+		return err
+	}
+	k.keys = append(k.keys, key)
+	return nil
+}
+
 func AuthKeyBytes(key []byte) (ssh.AuthMethod, error) {
 	k := new(keychain)
 	if err := k.PrivateKey(key); err != nil {
@@ -106,10 +283,156 @@ func AuthKeyFile(file string) (ssh.AuthMethod, error) {
 	return ssh.PublicKeys(k.keys...), nil
 }
 
+// AuthSigner returns an AuthMethod for keys already available as
+// signers, e.g. those held in a KMS or on a hardware token
+func AuthSigner(signers ...ssh.Signer) ssh.AuthMethod {
+	return ssh.PublicKeys(signers...)
+}
+
+// AuthCert returns an AuthMethod for a user certificate signed by an
+// ssh CA, as in certFile (e.g. id_ed25519-cert.pub), and its private
+// key in keyFile
+func AuthCert(certFile, keyFile string) (ssh.AuthMethod, error) {
+	k := new(keychain)
+	if err := k.PrivateKeyFile(keyFile); err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse %q -- %w", certFile, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a certificate", certFile)
+	}
+	signer, err := ssh.NewCertSigner(cert, k.keys[0])
+	if err != nil {
+		return nil, fmt.Errorf("can't use %q with %q -- %w", certFile, keyFile, err)
+	}
+	return ssh.PublicKeys(signer), nil
+}
+
+// AuthKeyBytesWithPassphrase returns an AuthMethod for a
+// passphrase protected private key
+func AuthKeyBytesWithPassphrase(key, passphrase []byte) (ssh.AuthMethod, error) {
+	k := new(keychain)
+	if err := k.PrivateKeyWithPassphrase(key, passphrase); err != nil {
+		return nil, err
+	}
+	return ssh.PublicKeys(k.keys...), nil
+}
+
+// AuthKeyFileWithPassphrase returns an AuthMethod for a
+// passphrase protected private key stored in file
+func AuthKeyFileWithPassphrase(file string, passphrase []byte) (ssh.AuthMethod, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return AuthKeyBytesWithPassphrase(buf, passphrase)
+}
+
 func AuthPassword(password string) (ssh.AuthMethod, error) {
 	return ssh.Password(password), nil
 }
 
+// defaultKeyFiles are the private keys the OpenSSH client tries by default
+var defaultKeyFiles = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+
+// AuthAny returns methods followed by whatever other credentials are
+// available, as the OpenSSH client uses by default: the keys held by
+// ssh-agent, and those default key files that exist and are unencrypted.
+// The ssh package only tries the first method of each kind, so these keys
+// are offered as a single public key method, which is never reached if
+// methods includes one of its own
+func AuthAny(methods ...ssh.AuthMethod) []ssh.AuthMethod {
+	if auth := defaultKeys(); auth != nil {
+		methods = append(methods, auth)
+	}
+	return methods
+}
+
+// DefaultAuthMethods returns the credentials the OpenSSH client would use
+// by default, as AuthAny does, failing with ErrNoAuthMethods if there are none
+func DefaultAuthMethods() ([]ssh.AuthMethod, error) {
+	auth := defaultKeys()
+	if auth == nil {
+		return nil, fmt.Errorf("no ssh-agent or default keys found: %w", ErrNoAuthMethods)
+	}
+	return []ssh.AuthMethod{auth}, nil
+}
+
+// DialDefault will open an ssh session using DefaultAuthMethods
+func DialDefault(server, username string, timeout int) (*Connection, error) {
+	auth, err := DefaultAuthMethods()
+	if err != nil {
+		return nil, err
+	}
+	return DialSSH(server, username, timeout, auth...)
+}
+
+// defaultKeys returns a public key method offering the keys held by
+// ssh-agent, then those in the default key files, or nil if there are none
+func defaultKeys() ssh.AuthMethod {
+	k := new(keychain)
+	for _, file := range defaultKeyFiles {
+		if path, err := expandHome(file); err == nil {
+			k.PrivateKeyFile(path)
+		}
+	}
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if len(k.keys) == 0 && (socket == "" || len(agentSigners(socket)) == 0) {
+		return nil
+	}
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		signers := k.keys
+		if socket == "" {
+			return signers, nil
+		}
+		return append(agentSigners(socket), signers...), nil
+	})
+}
+
+// sharedAgent is the ssh-agent connection the default key methods share,
+// rather than each dialing their own, as the agent's keys need it to stay
+// open to sign. It is redialed should it fail or SSH_AUTH_SOCK change
+var sharedAgent struct {
+	mu     sync.Mutex
+	socket string
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+// agentSigners returns the keys held by the ssh-agent at socket, if any
+func agentSigners(socket string) []ssh.Signer {
+	sharedAgent.mu.Lock()
+	defer sharedAgent.mu.Unlock()
+	if sharedAgent.conn != nil && sharedAgent.socket != socket {
+		sharedAgent.conn.Close()
+		sharedAgent.conn = nil
+	}
+	if sharedAgent.conn == nil {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil
+		}
+		sharedAgent.socket = socket
+		sharedAgent.conn = conn
+		sharedAgent.client = agent.NewClient(conn)
+	}
+	keys, err := sharedAgent.client.Signers()
+	if err != nil {
+		sharedAgent.conn.Close()
+		sharedAgent.conn = nil
+		return nil
+	}
+	return keys
+}
+
 //DialKey will open an ssh session using a private key
 func DialKey(server, username string, key []byte, timeout int) (*Connection, error) {
 	auth, err := AuthKeyBytes(key)
@@ -128,23 +451,112 @@ func DialKeyFile(server, username, keyfile string, timeout int) (*Connection, er
 	return DialSSH(server, username, timeout, auth)
 }
 
+// AuthKeyboardInteractive returns an AuthMethod that answers the server's
+// keyboard-interactive challenges (e.g. MFA prompts) with answerFn
+func AuthKeyboardInteractive(answerFn func(name, instruction string, questions []string, echos []bool) ([]string, error)) ssh.AuthMethod {
+	return ssh.KeyboardInteractive(answerFn)
+}
+
+// AuthKeyboardInteractiveAnswers returns an AuthMethod that replies to
+// keyboard-interactive questions with the given answers, in order
+func AuthKeyboardInteractiveAnswers(answers ...string) ssh.AuthMethod {
+	return ssh.KeyboardInteractive(cannedAnswers(answers))
+}
+
+// cannedAnswers returns a keyboard-interactive challenge handler
+// that hands out answers in order across however many rounds it takes
+func cannedAnswers(answers []string) ssh.KeyboardInteractiveChallenge {
+	next := 0
+	return func(_, _ string, questions []string, _ []bool) ([]string, error) {
+		if next+len(questions) > len(answers) {
+			return nil, fmt.Errorf("asked %d questions, but only %d answers left", len(questions), len(answers)-next)
+		}
+		reply := answers[next : next+len(questions)]
+		next += len(questions)
+		return reply, nil
+	}
+}
+
+// DialSigner will open an ssh session using the given signers
+func DialSigner(server, username string, timeout int, signers ...ssh.Signer) (*Connection, error) {
+	if len(signers) == 0 {
+		return nil, ErrNoAuthMethods
+	}
+	return DialSSH(server, username, timeout, AuthSigner(signers...))
+}
+
+// DialCert will open an ssh session using a user certificate,
+// as AuthCert does
+func DialCert(server, username, certFile, keyFile string, timeout int) (*Connection, error) {
+	auth, err := AuthCert(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return DialSSH(server, username, timeout, auth)
+}
+
+// DialKeyboardInteractive will open an ssh session answering
+// keyboard-interactive challenges with answerFn
+func DialKeyboardInteractive(server, username string, timeout int, answerFn func(name, instruction string, questions []string, echos []bool) ([]string, error)) (*Connection, error) {
+	return DialSSH(server, username, timeout, AuthKeyboardInteractive(answerFn))
+}
+
+// DialKeyFileWithPassphrase will open an ssh session using a
+// passphrase protected key stored in keyfile
+func DialKeyFileWithPassphrase(server, username, keyfile string, passphrase []byte, timeout int) (*Connection, error) {
+	auth, err := AuthKeyFileWithPassphrase(keyfile, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return DialSSH(server, username, timeout, auth)
+}
+
 //DialPassword will open an ssh session using the specified password
 func DialPassword(server, username, password string, timeout int) (*Connection, error) {
 	return DialSSH(server, username, timeout, ssh.Password(password))
 }
 
-// DialAgent makes a ssh connection with credentials from ssh-agent
-func DialAgent(server, username string, timeout int) (*Connection, error) {
+// dialAgent connects to the local ssh-agent
+func dialAgent() (net.Conn, error) {
 	socket := os.Getenv("SSH_AUTH_SOCK")
 	conn, err := net.Dial("unix", socket)
 	if err != nil {
-		return nil, fmt.Errorf("can't connect to ssh-agent: %w", err)
+		return nil, wrap(ErrAgentUnavailable, err)
+	}
+	return conn, nil
+}
+
+// ForwardAgent forwards the local ssh-agent to the remote host for the
+// connection's session, like `ssh -A`, so commands run there can use it,
+// e.g. to git clone. It must be called before the session is started,
+// only once per Connection, and the remote sshd must have
+// AllowAgentForwarding enabled
+func (s *Connection) ForwardAgent() error {
+	conn, err := dialAgent()
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	if err := agent.ForwardToRemote(s.client, os.Getenv("SSH_AUTH_SOCK")); err != nil {
+		return fmt.Errorf("can't forward agent -- %w", err)
+	}
+	if err := agent.RequestAgentForwarding(s.ssh); err != nil {
+		return fmt.Errorf("agent forwarding refused -- %w", err)
+	}
+	return nil
+}
+
+// DialAgent makes a ssh connection with credentials from ssh-agent
+func DialAgent(server, username string, timeout int) (*Connection, error) {
+	conn, err := dialAgent()
+	if err != nil {
+		return nil, err
 	}
 
 	agentClient := agent.NewClient(conn)
 	config := &ssh.ClientConfig{
 		User:    username,
-		Timeout: time.Duration(timeout) * time.Second,
+		Timeout: seconds(timeout),
 		Auth: []ssh.AuthMethod{
 			// Use a callback rather than PublicKeys so we only consult the
 			// agent once the remote server wants it.
@@ -156,146 +568,1035 @@ func DialAgent(server, username string, timeout int) (*Connection, error) {
 	return DialConfigSSH(server, username, config)
 }
 
-//DialConfigSSH will open an ssh session using the given config
-func DialConfigSSH(server, username string, config *ssh.ClientConfig) (*Connection, error) {
-	if !strings.Contains(server, ":") {
-		server += ":22"
-	}
-	conn, err := net.DialTimeout("tcp", server, config.Timeout)
-	if err != nil {
-		return nil, err
+//DialConfigSSH will open an ssh session using the given config,
+// as adjusted by any opts
+func DialConfigSSH(server, username string, config *ssh.ClientConfig, opts ...ConfigOption) (*Connection, error) {
+	if len(opts) > 0 && config != nil {
+		cfg := *config
+		for _, opt := range opts {
+			opt(&cfg)
+		}
+		config = &cfg
 	}
+	return DialContext(context.Background(), server, username, config)
+}
 
-	c, chans, reqs, err := ssh.NewClientConn(conn, server, config)
-	if err != nil {
-		return nil, err
+// ConfigOption adjusts a ClientConfig before it is dialed with
+type ConfigOption func(*ssh.ClientConfig)
+
+// WithBanner has onBanner called with the login banner, if the server
+// sends one. Should it return an error, the connection is abandoned
+func WithBanner(onBanner func(message string) error) ConfigOption {
+	return func(config *ssh.ClientConfig) {
+		config.BannerCallback = onBanner
 	}
-	return NewSession(ssh.NewClient(c, chans, reqs))
 }
 
-//DialSSH will open an ssh session using the specified authentication
-func DialSSH(server, username string, timeout int, auth ...ssh.AuthMethod) (*Connection, error) {
-	if len(auth) == 0 {
-		panic("no auth!")
-	}
-	config := &ssh.ClientConfig{
-		User:            username,
-		Auth:            auth,
-		Timeout:         time.Duration(timeout) * time.Second,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // TODO: find cleaner way for this
+// PreferHostKeyAlgos sets the host key algorithms to accept, in order of
+// preference, e.g. to have the server present the type of key known_hosts has
+func PreferHostKeyAlgos(algos ...string) ConfigOption {
+	return func(config *ssh.ClientConfig) {
+		config.HostKeyAlgorithms = algos
 	}
-	return DialConfigSSH(server, username, config)
 }
 
-// NewSession will open an ssh session using the provided connection
-func NewSession(client *ssh.Client) (*Connection, error) {
-	session, err := client.NewSession()
-	if err != nil {
-		return nil, err
+// WithAlgorithms sets the ciphers, MACs and key exchange algorithms
+// to offer, e.g. to reach old equipment that only supports legacy ones
+// such as aes128-cbc and diffie-hellman-group1-sha1.
+// Empty lists leave the ssh package's defaults in place
+func WithAlgorithms(ciphers, macs, kex []string) ConfigOption {
+	return func(config *ssh.ClientConfig) {
+		if len(ciphers) > 0 {
+			config.Ciphers = ciphers
+		}
+		if len(macs) > 0 {
+			config.MACs = macs
+		}
+		if len(kex) > 0 {
+			config.KeyExchanges = kex
+		}
 	}
+}
 
-	s := &Connection{ssh: session, client: client}
-	return s, nil
+// DialContext will open an ssh session using the given config,
+// abandoning the dial or handshake if ctx is done first
+func DialContext(ctx context.Context, server, username string, config *ssh.ClientConfig) (*Connection, error) {
+	return dialContext(ctx, nil, server, username, config, nil)
 }
 
-// Buffered insures that command output is captured
-func (s *Connection) Buffered() {
-	s.ssh.Stdout = &s.out
-	s.ssh.Stderr = &s.err
+// DialConfigSSHFrom will open an ssh session using the given config,
+// originating from localAddr, e.g. to go out a management interface
+func DialConfigSSHFrom(localAddr net.Addr, server, username string, config *ssh.ClientConfig) (*Connection, error) {
+	return dialContext(context.Background(), localAddr, server, username, config, nil)
 }
 
-// Terminal emulates a terminal
-func (s *Connection) Terminal() error {
-	// Set up terminal modes
-	modes := ssh.TerminalModes{
-		ssh.ECHO:          0,      // disable echoing
-		ssh.TTY_OP_ISPEED: 115200, // input speed  = 115.2kbps
-		ssh.TTY_OP_OSPEED: 115200, // output speed = 115.2kbps
+// dialContext does the work of DialContext, from localAddr if not nil,
+// recording how long it took in timings if not nil
+func dialContext(ctx context.Context, localAddr net.Addr, server, username string, config *ssh.ClientConfig, timings *DialTimings) (*Connection, error) {
+	if err := checkConfig(config); err != nil {
+		return nil, err
 	}
-	// Request pseudo terminal
-	if err := s.ssh.RequestPty("xterm", 80, 40, modes); err != nil {
-		s.client.Close()
-		return err
+	if timings == nil {
+		timings = new(DialTimings)
 	}
-	return nil
+	start := time.Now()
+	defer func() {
+		timings.Total = time.Since(start)
+	}()
+	server, err := withPort(server)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{Timeout: config.Timeout, LocalAddr: localAddr}
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	timings.TCPConnect = time.Since(start)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctxError(ctx, "dial "+server)
+		}
+		return nil, classifyDial(err)
+	}
+	s, err := clientConn(ctx, conn, server, config)
+	timings.Handshake = time.Since(start) - timings.TCPConnect
+	return s, err
 }
 
-// Run will run a command in the session
-func Run(session *Connection, cmd string) (Results, error) {
-	var rc int
-	var err error
-	if err = session.ssh.Run(cmd); err != nil {
-		if err2, ok := err.(*ssh.ExitError); ok {
-			rc = err2.Waitmsg.ExitStatus()
-		}
+// checkConfig rejects a config that could never authenticate
+func checkConfig(config *ssh.ClientConfig) error {
+	if config == nil || len(config.Auth) == 0 {
+		return ErrNoAuthMethods
 	}
-	return Results{rc, session.out.String(), session.err.String()}, err
+	return nil
 }
 
-// ExecPassword will run a single command using the given password
-func ExecPassword(server, username, password, cmd string, timeout int) (Results, error) {
-	session, err := DialPassword(server, username, password, timeout)
-	if err != nil {
-		return Results{}, err
+// DefaultPort is the port dialing uses for addresses that don't give one.
+// Set it to "" to have such addresses rejected instead
+var DefaultPort = "22"
+
+// withPort adds DefaultPort to server if it has no port,
+// so a bare IPv6 address such as fe80::1 becomes [fe80::1]:22
+func withPort(server string) (string, error) {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server, nil
 	}
-	session.Buffered()
-	return Run(session, cmd)
+	if DefaultPort == "" {
+		return "", fmt.Errorf("%q has no port and there is no DefaultPort", server)
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(server, "["), "]")
+	return net.JoinHostPort(host, DefaultPort), nil
 }
 
-// ExecText will run a single command using the given key
-func ExecText(server, username, cmd string, keybytes []byte, timeout int) (Results, error) {
-	session, err := DialKey(server, username, keybytes, timeout)
+// DialJump will open an ssh session to server by way of the bastion,
+// like `ssh -J`. Closing the returned Connection leaves the bastion open,
+// unless its CloseBastion is set
+func DialJump(bastion *Connection, server, username string, config *ssh.ClientConfig) (*Connection, error) {
+	if err := checkConfig(config); err != nil {
+		return nil, err
+	}
+	server, err := withPort(server)
 	if err != nil {
-		return Results{}, err
+		return nil, err
 	}
-	session.Buffered()
-	return Run(session, cmd)
+	conn, err := bastion.client.Dial("tcp", server)
+	if err != nil {
+		return nil, fmt.Errorf("can't reach %s via bastion: %w", server, err)
+	}
+	s, err := clientConn(context.Background(), conn, server, config)
+	if err != nil {
+		return nil, err
+	}
+	s.bastion = bastion
+	return s, nil
 }
 
-// ExecAgent will run a single command using ssh-agent
-func ExecAgent(server, username, cmd string, timeout int) (Results, error) {
-	session, err := DialAgent(server, username, timeout)
-	if err != nil {
-		return Results{}, err
+// NewClientConn will open an ssh session over conn, a connection the
+// caller has already made by whatever means, e.g. to a Unix socket or
+// through a proxy. The addr is the server's address, as passed
+// to the config's HostKeyCallback
+func NewClientConn(conn net.Conn, addr string, config *ssh.ClientConfig) (*Connection, error) {
+	if err := checkConfig(config); err != nil {
+		return nil, err
 	}
-	session.Buffered()
-	return Run(session, cmd)
+	return clientConn(context.Background(), conn, addr, config)
 }
 
-// CopyFile scp's filename to dest on the remote host
-func (s *Connection) CopyFile(filename, dest string) error {
-	info, err := os.Stat(filename)
+// clientConn performs the ssh handshake over conn, abandoning it if
+// ctx is done first
+func clientConn(ctx context.Context, conn net.Conn, server string, config *ssh.ClientConfig) (*Connection, error) {
+	// the handshake can't be canceled, so pull the conn out from under it
+	stop := make(chan struct{})
+	canceled := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			canceled <- true
+		case <-stop:
+			canceled <- false
+		}
+	}()
+
+	// the handshake error flattens the host key and banner errors
+	// to text, so hang on to them to preserve their types
+	var hostKeyErr, bannerErr error
+	var hostKey ssh.PublicKey
+	var hostKeyAddr string
+	cfg := *config
+	if check := config.HostKeyCallback; check != nil {
+		cfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey, hostKeyAddr = key, hostname
+			hostKeyErr = check(hostname, remote, key)
+			return hostKeyErr
+		}
+	}
+	if onBanner := config.BannerCallback; onBanner != nil {
+		cfg.BannerCallback = func(message string) error {
+			bannerErr = onBanner(message)
+			return bannerErr
+		}
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, server, &cfg)
+	close(stop)
+	if <-canceled {
+		if err == nil {
+			c.Close()
+		}
+		return nil, ctxError(ctx, "handshake with "+server)
+	}
 	if err != nil {
-		return err
+		if hostKeyErr != nil {
+			return nil, hostKeyErr
+		}
+		if bannerErr != nil {
+			return nil, bannerErr
+		}
+		return nil, classifyHandshake(err)
 	}
-	f, err := os.Open(filename)
+	s, err := NewSession(ssh.NewClient(c, chans, reqs))
 	if err != nil {
-		return fmt.Errorf("can't open %q -- %w", filename, err)
+		return nil, err
 	}
-	defer f.Close()
-	return s.Copy(f, filepath.Base(filename), dest, info.Size(), info.Mode())
+	s.conn = conn
+	s.hostKey, s.hostKeyAddr = hostKey, hostKeyAddr
+	return s, nil
 }
 
-// Copy scp's the reader contents to filename on the remote host
-func (s *Connection) Copy(r io.Reader, filename, dest string, size int64, mode os.FileMode) error {
-	w, err := s.ssh.StdinPipe()
+// expandHome expands a leading "~/" in path to the user's home directory
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
 	if err != nil {
-		return err
+		return "", fmt.Errorf("can't find home dir to find `~`: %w", err)
 	}
+	return filepath.Join(home, path[2:]), nil
+}
 
-	// capture stdout & stderr for feedback on remote errors
-	s.Buffered()
+// HostKey returns the host key the server presented when the connection
+// was dialed, whether or not it was checked, and its SHA256 fingerprint,
+// e.g. to trust it on first use. The key is nil for a Connection
+// made from an existing client, by NewSession or AttachSession
+func (s *Connection) HostKey() (ssh.PublicKey, string) {
+	if s.hostKey == nil {
+		return nil, ""
+	}
+	return s.hostKey, ssh.FingerprintSHA256(s.hostKey)
+}
 
-	cmd := fmt.Sprintf("/usr/bin/env scp -tq %s", dest)
-	if err := s.ssh.Start(cmd); err != nil {
+// KnownHostsLine returns the server's host key as a line to add to a
+// known_hosts file, for the address it was dialed at, or "" if HostKey
+// has no key. The line has no trailing newline
+func (s *Connection) KnownHostsLine() string {
+	if s.hostKey == nil {
+		return ""
+	}
+	return knownhosts.Line([]string{s.hostKeyAddr}, s.hostKey)
+}
+
+// KnownHostsFile returns a HostKeyCallback that verifies host keys against
+// the given known_hosts file. Unknown or mismatched keys are reported
+// as ErrHostKeyUnknown or ErrHostKeyMismatch, naming the host and the
+// fingerprint of the key it presented
+func KnownHostsFile(path string) (ssh.HostKeyCallback, error) {
+	path, err := expandHome(path)
+	if err != nil {
+		return nil, err
+	}
+	check, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't load known hosts %q -- %w", path, err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		var kerr *knownhosts.KeyError
+		if !errors.As(err, &kerr) {
+			return err
+		}
+		if len(kerr.Want) == 0 {
+			return wrap(ErrHostKeyUnknown, fmt.Errorf("%s presented %s key %s: %w",
+				hostname, key.Type(), ssh.FingerprintSHA256(key), err))
+		}
+		known := kerr.Want[0]
+		return wrap(ErrHostKeyMismatch, fmt.Errorf("%s presented %s key %s, expected %s key %s (%s:%d): %w",
+			hostname, key.Type(), ssh.FingerprintSHA256(key),
+			known.Key.Type(), ssh.FingerprintSHA256(known.Key), known.Filename, known.Line, err))
+	}, nil
+}
+
+// DialKnownHosts will open an ssh session using the specified authentication,
+// verifying the host key against the knownHosts file
+func DialKnownHosts(server, username, knownHosts string, timeout int, auth ...ssh.AuthMethod) (*Connection, error) {
+	if len(auth) == 0 {
+		return nil, ErrNoAuthMethods
+	}
+	callback, err := KnownHostsFile(knownHosts)
+	if err != nil {
+		return nil, err
+	}
+	return Dial(server, username, DialOptions{
+		Timeout:         seconds(timeout),
+		Auth:            auth,
+		HostKeyCallback: callback,
+	})
+}
+
+//DialSSH will open an ssh session using the specified authentication.
+// As for the other Dial functions taking an int, timeout is in seconds;
+// for a time.Duration, e.g. to time out in under a second, use Dial
+func DialSSH(server, username string, timeout int, auth ...ssh.AuthMethod) (*Connection, error) {
+	return Dial(server, username, DialOptions{
+		Timeout: seconds(timeout),
+		Auth:    auth,
+	})
+}
+
+// seconds converts the timeout the older Dial functions take to a Duration
+func seconds(timeout int) time.Duration {
+	return time.Duration(timeout) * time.Second
+}
+
+// DialWithBanner will open an ssh session using the specified authentication,
+// passing the server's login banner to onBanner, as WithBanner does
+func DialWithBanner(server, username string, timeout int, onBanner func(message string) error, auth ...ssh.AuthMethod) (*Connection, error) {
+	return Dial(server, username, DialOptions{
+		Timeout:        seconds(timeout),
+		Auth:           auth,
+		BannerCallback: onBanner,
+	})
+}
+
+// dialConfig is the config DialSSH and friends connect with
+func dialConfig(username string, timeout int, auth []ssh.AuthMethod) *ssh.ClientConfig {
+	return DialOptions{Timeout: seconds(timeout), Auth: auth}.config(username)
+}
+
+// DialRetry is DialSSH, retrying up to attempts times in all while the
+// server is unreachable or times out, as when it is still booting.
+// The wait between attempts starts at backoff and doubles each time,
+// waiting no more than a minute.
+// Other failures, such as rejected credentials, are returned at once
+func DialRetry(server, username string, timeout int, attempts int, backoff time.Duration, auth ...ssh.AuthMethod) (*Connection, error) {
+	return DialRetryContext(context.Background(), server, username, timeout, attempts, backoff, auth...)
+}
+
+// DialRetryContext is DialRetry, giving up once ctx is done
+func DialRetryContext(ctx context.Context, server, username string, timeout int, attempts int, backoff time.Duration, auth ...ssh.AuthMethod) (*Connection, error) {
+	return DialRetryOptions(ctx, server, username, DialOptions{Timeout: seconds(timeout), Auth: auth}, attempts, backoff)
+}
+
+// DialRetryOptions is DialRetryContext, dialing as opts specify
+func DialRetryOptions(ctx context.Context, server, username string, opts DialOptions, attempts int, backoff time.Duration) (*Connection, error) {
+	if len(opts.Auth) == 0 {
+		return nil, ErrNoAuthMethods
+	}
+	config := opts.config(username)
+	for i := 1; ; i++ {
+		s, err := dialContext(ctx, opts.LocalAddr, server, username, config, nil)
+		if err == nil {
+			s.Environment = opts.Env
+			return s, nil
+		}
+		if !retryable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		if i >= attempts {
+			return nil, fmt.Errorf("gave up after %d attempts: %w", i, err)
+		}
+		timer := time.NewTimer(retryWait(backoff, i))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctxError(ctx, "dial "+server)
+		case <-timer.C:
+		}
+	}
+}
+
+// maxBackoff is the longest DialRetry waits between attempts
+const maxBackoff = time.Minute
+
+// retryWait returns how long to wait after the given attempt, doubling
+// backoff for each one before it, up to maxBackoff
+func retryWait(backoff time.Duration, attempt int) time.Duration {
+	wait := backoff
+	for i := 1; i < attempt && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		return maxBackoff
+	}
+	return wait
+}
+
+// retryable reports whether a dial failure might clear up by itself
+func retryable(err error) bool {
+	return errors.Is(err, ErrHostUnreachable) || errors.Is(err, ErrTimeout)
+}
+
+// NewSession will open an ssh session using the provided connection
+func NewSession(client *ssh.Client) (*Connection, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Connection{ssh: session, client: client}
+	return s, nil
+}
+
+// AttachSession opens an ssh session on a client shared with others,
+// such as other Connections attached to it. Unlike with NewSession,
+// closing the Connection only closes its session, leaving the client
+// open, for whoever is sharing it to close when they're done
+func AttachSession(client *ssh.Client) (*Connection, error) {
+	s, err := NewSession(client)
+	if err != nil {
+		return nil, err
+	}
+	s.attached = true
+	return s, nil
+}
+
+// Buffered insures that command output is captured
+func (s *Connection) Buffered() {
+	s.ssh.Stdout = &s.out
+	s.ssh.Stderr = &s.err
+}
+
+// Combined captures stdout and stderr together, in the order they arrive,
+// like os/exec's CombinedOutput. Results from Run then have it all in Stdout
+func (s *Connection) Combined() {
+	w := &lockedWriter{w: &s.out}
+	s.ssh.Stdout = w
+	s.ssh.Stderr = w
+}
+
+// lockedWriter serializes writes, so stdout and stderr can share a writer
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(b []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(b)
+}
+
+// StreamOutput sends the output of the next command run in the session
+// to the given writers as it arrives, rather than buffering it.
+// Results from Run will then have empty Stdout and Stderr.
+// Callers must not also call Buffered, which would undo this
+func (s *Connection) StreamOutput(stdout, stderr io.Writer) error {
+	if s.ssh.Stdout == &s.out || s.ssh.Stderr == &s.err {
+		return errors.New("session output is already buffered")
+	}
+	s.ssh.Stdout = stdout
+	s.ssh.Stderr = stderr
+	return nil
+}
+
+// StdoutPipe returns a reader for the stdout of the next command run in
+// the session, e.g. to gzip a dump as it arrives. It must be called
+// before Start, and not with Buffered or StreamOutput, which take over
+// stdout. Read it to EOF before calling Wait, which would otherwise
+// block as the command's output backs up
+func (s *Connection) StdoutPipe() (io.Reader, error) {
+	return s.ssh.StdoutPipe()
+}
+
+// StderrPipe returns a reader for the stderr of the next command run in
+// the session, as StdoutPipe does for stdout and with the same rules
+func (s *Connection) StderrPipe() (io.Reader, error) {
+	return s.ssh.StderrPipe()
+}
+
+// Terminal emulates a terminal
+func (s *Connection) Terminal() error {
+	// the pty has always been requested 80 rows by 40 columns
+	return s.TerminalSize("xterm", 40, 80, nil)
+}
+
+// TerminalSize requests a pseudo terminal of the given type and size
+// for the connection's session. Nil modes default to those of Terminal,
+// i.e. no echo at 115.2kbps
+func (s *Connection) TerminalSize(term string, width, height int, modes ssh.TerminalModes) error {
+	if modes == nil {
+		modes = ssh.TerminalModes{
+			ssh.ECHO:          0,      // disable echoing
+			ssh.TTY_OP_ISPEED: 115200, // input speed  = 115.2kbps
+			ssh.TTY_OP_OSPEED: 115200, // output speed = 115.2kbps
+		}
+	}
+	// Request pseudo terminal
+	if err := s.ssh.RequestPty(term, height, width, modes); err != nil {
+		s.client.Close()
+		return err
+	}
+	return nil
+}
+
+// WindowChange tells the remote pty that the terminal has been resized
+func (s *Connection) WindowChange(width, height int) error {
+	return s.ssh.WindowChange(height, width)
+}
+
+// Signal sends sig to the command running in the connection's session,
+// e.g. ssh.SIGHUP to have a daemon reload or ssh.SIGINT to stop `tail -f`.
+// OpenSSH's sshd only honors signal requests from version 7.9 on,
+// and other servers may ignore them, as may a command run under a pty.
+// No reply is requested, so an error only means the session is gone
+func (s *Connection) Signal(sig ssh.Signal) error {
+	return s.ssh.Signal(sig)
+}
+
+// exitCode extracts the remote exit status from a session error.
+// A command whose status is unknown, as it ended without reporting it
+// or the session failed, gets -1
+func exitCode(err error) int {
+	switch err := err.(type) {
+	case nil:
+		return 0
+	case *ssh.ExitError:
+		return err.Waitmsg.ExitStatus()
+	}
+	return -1
+}
+
+// exitError marks a session that ended without reporting the command's
+// exit status as ErrExitUnknown, as the command may or may not have
+// succeeded. Other errors, such as the command failing to start,
+// are returned as they are
+func exitError(err error) error {
+	if _, ok := err.(*ssh.ExitMissingError); ok {
+		return wrap(ErrExitUnknown, err)
+	}
+	return err
+}
+
+// exitSignal extracts the signal, if any, that killed the remote command
+func exitSignal(err error) string {
+	if err, ok := err.(*ssh.ExitError); ok {
+		return err.Waitmsg.Signal()
+	}
+	return ""
+}
+
+// newResults gathers up the outcome of a command run in a session
+func newResults(err error, stdout, stderr string) Results {
+	return Results{
+		RC:     exitCode(err),
+		Stdout: stdout,
+		Stderr: stderr,
+		Signal: exitSignal(err),
+	}
+}
+
+// Run will run a command in the session
+func Run(session *Connection, cmd string) (Results, error) {
+	done, err := session.busy()
+	if err != nil {
+		return Results{}, err
+	}
+	defer done()
+	if err := session.applyEnv(); err != nil {
+		return Results{}, err
+	}
+	err = exitError(session.ssh.Run(cmd))
+	return newResults(err, session.out.String(), session.err.String()), err
+}
+
+// Start starts cmd in the connection's session without waiting for it
+// to complete, so it can be signalled or its output streamed meanwhile.
+// Collect its results with Wait. The connection counts as in use until then
+func (s *Connection) Start(cmd string) error {
+	done, err := s.busy()
+	if err != nil {
+		return err
+	}
+	if err := s.applyEnv(); err != nil {
+		done()
+		return err
+	}
+	if err := s.ssh.Start(cmd); err != nil {
+		done()
+		return err
+	}
+	s.startDone = done
+	return nil
+}
+
+// Wait waits for the command begun by Start to exit, returning its results
+func (s *Connection) Wait() (Results, error) {
+	done := s.startDone
+	s.startDone = nil
+	if done == nil {
+		var err error
+		if done, err = s.busy(); err != nil {
+			return Results{}, err
+		}
+	}
+	defer done()
+	err := exitError(s.ssh.Wait())
+	return newResults(err, s.out.String(), s.err.String()), err
+}
+
+// RunStdin will run a command in the session, with stdin as its input.
+// The remote command sees EOF once stdin is drained
+func RunStdin(session *Connection, cmd string, stdin io.Reader) (Results, error) {
+	session.ssh.Stdin = stdin
+	return Run(session, cmd)
+}
+
+// RunContext will run a command in the session, sending it SIGTERM and
+// closing the session to abort it if ctx is done before it completes
+func RunContext(ctx context.Context, session *Connection, cmd string) (Results, error) {
+	idle, err := session.busy()
+	if err != nil {
+		return Results{}, err
+	}
+	defer idle()
+	if err := session.applyEnv(); err != nil {
+		return Results{}, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.ssh.Run(cmd)
+	}()
+	select {
+	case err := <-done:
+		err = exitError(err)
+		return newResults(err, session.out.String(), session.err.String()), err
+	case <-ctx.Done():
+		session.ssh.Signal(ssh.SIGTERM)
+		session.ssh.Close()
+		err := <-done
+		return newResults(err, session.out.String(), session.err.String()), ctxError(ctx, "run "+cmd)
+	}
+}
+
+// RunTimeout will run a command in the session, aborting it as RunContext
+// does if it runs longer than timeout. Only the session is closed,
+// leaving the connection open for further commands
+func RunTimeout(session *Connection, cmd string, timeout time.Duration) (Results, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return RunContext(ctx, session, cmd)
+}
+
+// RunFiles runs cmd with its streams redirected to local files, the remote
+// equivalent of `cmd < stdinPath > stdoutPath 2> stderrPath`.
+// An empty path leaves that stream unredirected.
+// It returns the exit code of the command
+func (s *Connection) RunFiles(cmd, stdinPath, stdoutPath, stderrPath string) (int, error) {
+	done, err := s.busy()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	if err := s.applyEnv(); err != nil {
+		return 0, err
+	}
+	if stdinPath != "" {
+		f, err := os.Open(stdinPath)
+		if err != nil {
+			return 0, fmt.Errorf("can't open %q -- %w", stdinPath, err)
+		}
+		defer f.Close()
+		s.ssh.Stdin = f
+	}
+	if stdoutPath != "" {
+		f, err := os.Create(stdoutPath)
+		if err != nil {
+			return 0, fmt.Errorf("can't create %q -- %w", stdoutPath, err)
+		}
+		defer f.Close()
+		s.ssh.Stdout = f
+	}
+	if stderrPath != "" {
+		f, err := os.Create(stderrPath)
+		if err != nil {
+			return 0, fmt.Errorf("can't create %q -- %w", stderrPath, err)
+		}
+		defer f.Close()
+		s.ssh.Stderr = f
+	}
+	err = exitError(s.ssh.Run(cmd))
+	return exitCode(err), err
+}
+
+// ExecPassword will run a single command using the given password
+func ExecPassword(server, username, password, cmd string, timeout int) (Results, error) {
+	session, err := DialPassword(server, username, password, timeout)
+	if err != nil {
+		return Results{}, err
+	}
+	session.Buffered()
+	return Run(session, cmd)
+}
+
+// ExecText will run a single command using the given key
+func ExecText(server, username, cmd string, keybytes []byte, timeout int) (Results, error) {
+	session, err := DialKey(server, username, keybytes, timeout)
+	if err != nil {
+		return Results{}, err
+	}
+	session.Buffered()
+	return Run(session, cmd)
+}
+
+// ExecAgent will run a single command using ssh-agent
+func ExecAgent(server, username, cmd string, timeout int) (Results, error) {
+	session, err := DialAgent(server, username, timeout)
+	if err != nil {
+		return Results{}, err
+	}
+	session.Buffered()
+	return Run(session, cmd)
+}
+
+// CopyFile scp's filename to dest on the remote host.
+// If dest's directory doesn't exist, the error matches ErrRemoteDirMissing
+func (s *Connection) CopyFile(filename, dest string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if err := s.checkSize(filename, info.Size()); err != nil {
+		return err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("can't open %q -- %w", filename, err)
+	}
+	defer f.Close()
+	return s.Copy(f, filepath.Base(filename), dest, info.Size(), info.Mode())
+}
+
+// CopyFileMkdir scp's filename into destDir on the remote host,
+// creating destDir first if need be
+func (s *Connection) CopyFileMkdir(filename, destDir string) error {
+	if r, err := s.runSession("mkdir -p " + shellQuote(destDir)); err != nil {
+		if _, ok := err.(*ssh.ExitError); ok {
+			return CmdError{RC: r.RC, Stdout: r.Stdout, Stderr: r.Stderr}
+		}
+		return err
+	}
+	return s.CopyFile(filename, destDir)
+}
+
+// WriteFile uploads content to remotePath on the remote host,
+// as Copy does, without needing a local file
+func (s *Connection) WriteFile(content []byte, remotePath string, mode os.FileMode) error {
+	dir, filename := path.Split(remotePath)
+	if dir == "" {
+		dir = "."
+	}
+	return s.Copy(bytes.NewReader(content), filename, dir, int64(len(content)), mode)
+}
+
+// checkSize enforces MaxFileSize for an upload of the given size
+func (s *Connection) checkSize(filename string, size int64) error {
+	if s.MaxFileSize > 0 && size > s.MaxFileSize {
+		return fmt.Errorf("%q is %d bytes (limit %d): %w", filename, size, s.MaxFileSize, ErrFileTooLarge)
+	}
+	return nil
+}
+
+// DefaultScpCommand is how scp is run on the remote host,
+// unless the Connection's ScpCommand says otherwise
+const DefaultScpCommand = "/usr/bin/env scp"
+
+// scpCommand returns the remote command to run scp with flags and path
+func (s *Connection) scpCommand(flags, path string) string {
+	scp := s.ScpCommand
+	if scp == "" {
+		scp = DefaultScpCommand
+	}
+	return scp + " " + flags + " " + path
+}
+
+// scpAvailable reports whether the remote host has an scp binary,
+// probing once per connection in a separate session
+func (s *Connection) scpAvailable() bool {
+	s.scpOnce.Do(func() {
+		// if the probe itself can't run, assume scp is there
+		s.hasSCP = true
+		if s.ScpCommand != "" {
+			return
+		}
+		session, err := s.client.NewSession()
+		if err != nil {
+			return
+		}
+		defer session.Close()
+		if _, ok := session.Run("command -v scp").(*ssh.ExitError); ok {
+			s.hasSCP = false
+		}
+	})
+	return s.hasSCP
+}
+
+// shellQuote quotes s for use as a single word in a remote shell command
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// runSession runs cmd in a new session of its own, leaving the
+// connection's session and buffers untouched
+func (s *Connection) runSession(cmd string) (Results, error) {
+	done, err := s.busy()
+	if err != nil {
+		return Results{}, err
+	}
+	defer done()
+	session, err := s.client.NewSession()
+	if err != nil {
+		return Results{}, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	err = exitError(session.Run(cmd))
+	return newResults(err, stdout.String(), stderr.String()), err
+}
+
+// remoteMatches reports whether the file an upload would create already
+// exists on the remote host with the same contents, per ResumeCompare.
+// A checksum comparison needs to read r, so it is only made if r can be
+// rewound afterwards
+func (s *Connection) remoteMatches(r io.Reader, filename, dest string, size int64) bool {
+	// scp writes into dest if it's a directory, otherwise to dest itself
+	target := fmt.Sprintf(`f=%s; [ -d "$f" ] && f="$f"/%s; `, shellQuote(dest), shellQuote(filename))
+	switch s.ResumeCompare {
+	case CompareChecksum:
+		rs, ok := r.(io.ReadSeeker)
+		if !ok {
+			return false
+		}
+		pos, err := rs.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return false
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, rs)
+		if _, serr := rs.Seek(pos, io.SeekStart); err != nil || serr != nil {
+			return false
+		}
+		res, err := s.runSession(target + `sha256sum "$f"`)
+		if err != nil {
+			return false
+		}
+		fields := strings.Fields(res.Stdout)
+		return len(fields) > 0 && fields[0] == hex.EncodeToString(h.Sum(nil))
+	default:
+		res, err := s.runSession(target + `stat -c%s "$f"`)
+		if err != nil {
+			return false
+		}
+		remote, err := strconv.ParseInt(strings.TrimSpace(res.Stdout), 10, 64)
+		return err == nil && remote == size
+	}
+}
+
+// Skipped reports whether the most recent Copy was skipped
+// because ResumeIfPresent found the remote file already in place
+func (s *Connection) Skipped() bool {
+	s.lastMu.Lock()
+	defer s.lastMu.Unlock()
+	return s.skipped
+}
+
+// LastTransport reports which protocol the most recent Copy, Upload or Download used
+func (s *Connection) LastTransport() Transport {
+	s.lastMu.Lock()
+	defer s.lastMu.Unlock()
+	return s.transport
+}
+
+func (s *Connection) setSkipped(skipped bool) {
+	s.lastMu.Lock()
+	s.skipped = skipped
+	s.lastMu.Unlock()
+}
+
+func (s *Connection) setTransport(transport Transport) {
+	s.lastMu.Lock()
+	s.transport = transport
+	s.lastMu.Unlock()
+}
+
+// Copy scp's the reader contents to filename on the remote host.
+// With ResumeIfPresent set, a matching remote file is left alone.
+// If the remote host has no scp the file is sent over sftp instead,
+// unless NoSFTPFallback is set
+func (s *Connection) Copy(r io.Reader, filename, dest string, size int64, mode os.FileMode) error {
+	return s.CopyWithProgress(r, filename, dest, size, mode, nil)
+}
+
+// progressInterval is the most often progress is reported during a copy
+const progressInterval = 100 * time.Millisecond
+
+// CopyWithProgress is Copy, calling onProgress with the bytes sent so far
+// as the copy proceeds, at most every progressInterval and at the end
+func (s *Connection) CopyWithProgress(r io.Reader, filename, dest string, size int64, mode os.FileMode, onProgress func(written, total int64)) error {
+	return s.copyContext(context.Background(), r, filename, dest, size, mode, onProgress)
+}
+
+// CopyContext is Copy, abandoning the transfer if ctx is done first.
+// The transfer's session is then closed, so the remote scp is stopped
+// rather than left waiting for the rest of the file
+func (s *Connection) CopyContext(ctx context.Context, r io.Reader, filename, dest string, size int64, mode os.FileMode) error {
+	return s.copyContext(ctx, r, filename, dest, size, mode, nil)
+}
+
+// copyContext does the copying for Copy and its variants
+func (s *Connection) copyContext(ctx context.Context, r io.Reader, filename, dest string, size int64, mode os.FileMode, onProgress func(written, total int64)) error {
+	done, err := s.busy()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := ctx.Err(); err != nil {
+		return ctxError(ctx, "copy "+filename)
+	}
+	if err := s.checkSize(filename, size); err != nil {
+		return err
+	}
+	skipped := s.ResumeIfPresent && s.remoteMatches(r, filename, dest, size)
+	s.setSkipped(skipped)
+	if skipped {
+		return nil
+	}
+	if onProgress != nil {
+		r = &progressReader{r: r, total: size, last: time.Now(), fn: onProgress}
+	}
+	if s.CopyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.CopyTimeout)
+		defer cancel()
+	}
+	if ctx.Done() != nil {
+		r = &ctxReader{ctx: ctx, r: r}
+	}
+	if !s.NoSFTPFallback && !s.scpAvailable() {
+		s.setTransport(TransportSFTP)
+		err = s.sftpCopy(ctx, r, filename, dest, mode)
+	} else {
+		s.setTransport(TransportSCP)
+		err = s.scpCopy(ctx, r, filename, dest, size, mode)
+	}
+	// the transfer fails every which way when its session is closed
+	// on it, so report why it was
+	if err != nil && ctx.Err() != nil {
+		return ctxError(ctx, "copy "+filename)
+	}
+	return err
+}
+
+// closeOnDone closes c if ctx is done before the returned stop is called
+func closeOnDone(ctx context.Context, c io.Closer) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
+}
+
+// ctxReader stops reading once ctx is done, so a copy from it stops too
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// progressReader reports how much of total has been read through it
+type progressReader struct {
+	r           io.Reader
+	read, total int64
+	last        time.Time
+	fn          func(read, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.read += int64(n)
+		if now := time.Now(); p.read == p.total || now.Sub(p.last) >= progressInterval {
+			p.last = now
+			p.fn(p.read, p.total)
+		}
+	}
+	return n, err
+}
+
+// scpCopy sends the reader contents via the scp protocol, in a session
+// of its own so the connection's session and its writers are left alone.
+// The session is closed to abort the transfer if ctx is done first
+func (s *Connection) scpCopy(ctx context.Context, r io.Reader, filename, dest string, size int64, mode os.FileMode) error {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	defer closeOnDone(ctx, session)()
+
+	w, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	// capture stdout & stderr for feedback on remote errors
+	var sout, serr bytes.Buffer
+	session.Stdout = &sout
+	session.Stderr = &serr
+
+	cmd := s.scpCommand("-tq", dest)
+	if err := session.Start(cmd); err != nil {
 		w.Close()
 		return fmt.Errorf("start failed: %w", err)
 	}
 
-	errors := make(chan error)
+	errors := make(chan error, 1)
 
 	go func() {
-		errors <- s.ssh.Wait()
+		errors <- session.Wait()
 	}()
 
 	// send the SCP Create command
@@ -315,31 +1616,334 @@ func (s *Connection) Copy(r io.Reader, filename, dest string, size int64, mode o
 	}
 
 	// get more details about the error
-	if serr, ok := err.(*ssh.ExitError); ok {
-		rc := serr.Waitmsg.ExitStatus()
-		stderr := s.err.String()
-		stdout := s.out.String()
-		// scp errors start with a null byte and are separated by "markers",
-		// values 0, 1, 2 -- for ok, warning, error (respectively)
-		// I believe we only care about the first line
-		if len(stdout) > 2 {
-			b := []byte(stdout)
-			// skip the leading 0
-			b = b[1:]
-			fn := func(c rune) bool {
-				return c < 3
-			}
-			parts := bytes.FieldsFunc(b, fn)
-			stdout = string(parts[0])
-			stdout = strings.TrimRight(stdout, "\n")
+	if xerr, ok := err.(*ssh.ExitError); ok {
+		rc := xerr.Waitmsg.ExitStatus()
+		stderr := serr.String()
+		stdout := sout.String()
+		cerr := CmdError{RC: rc, Stdout: stdout, Stderr: stderr}
+		if level, msg := scpStatus(stdout); level != 0 {
+			cerr.Stdout = msg
+			cerr.SCPLevel, cerr.SCPMessage = level, msg
 		}
-		return CmdError{rc, stdout, stderr}
+		if strings.Contains(stdout, "No such file or directory") || strings.Contains(stderr, "No such file or directory") {
+			return wrap(ErrRemoteDirMissing, fmt.Errorf("%q: %w", dest, cerr))
+		}
+		return cerr
 	}
 	return err
 }
 
-// Exec will run a single command in this session
+// Fetch scp's remotePath from the remote host into w,
+// returning the file's mode and size
+func (s *Connection) Fetch(remotePath string, w io.Writer) (os.FileMode, int64, error) {
+	done, err := s.busy()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer done()
+	session, err := s.client.NewSession()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	in, err := session.StdinPipe()
+	if err != nil {
+		return 0, 0, err
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		return 0, 0, err
+	}
+	r := bufio.NewReader(out)
+
+	cmd := s.scpCommand("-fq", remotePath)
+	if err := session.Start(cmd); err != nil {
+		return 0, 0, fmt.Errorf("start failed: %w", err)
+	}
+
+	// fail reports a protocol error, or the remote's reason for it
+	fail := func(err error) (os.FileMode, int64, error) {
+		in.Close()
+		if werr := session.Wait(); werr != nil {
+			if _, ok := werr.(*ssh.ExitError); ok {
+				var cerr CmdError
+				if errors.As(err, &cerr) {
+					cerr.RC = exitCode(werr)
+					return 0, 0, cerr
+				}
+				return 0, 0, CmdError{RC: exitCode(werr), Stderr: stderr.String()}
+			}
+		}
+		return 0, 0, err
+	}
+
+	// ack tells the source we're ready for more; should the remote be
+	// gone, the next read will tell us why
+	ack := func() {
+		in.Write([]byte{0})
+	}
+
+	ack()
+	line, err := readSCPLine(r)
+	if err != nil {
+		return fail(err)
+	}
+	// expecting "C<mode> <size> <name>"
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[0], "C") {
+		return fail(fmt.Errorf("unexpected scp header: %q", line))
+	}
+	mode, err := strconv.ParseUint(parts[0][1:], 8, 32)
+	if err != nil {
+		return fail(fmt.Errorf("bad mode in scp header %q: %w", line, err))
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return fail(fmt.Errorf("bad size in scp header: %q", line))
+	}
+
+	ack()
+	if n, err := io.CopyN(w, r, size); err != nil {
+		return fail(fmt.Errorf("copy %d of %d with error: %w", n, size, err))
+	}
+	// the file contents are followed by a status byte
+	if b, err := r.ReadByte(); err != nil {
+		return fail(err)
+	} else if b != 0 {
+		r.UnreadByte()
+		_, err := readSCPLine(r)
+		return fail(err)
+	}
+	ack()
+	in.Close()
+
+	if err := session.Wait(); err != nil {
+		if _, ok := err.(*ssh.ExitError); ok {
+			return 0, 0, CmdError{RC: exitCode(err), Stderr: stderr.String()}
+		}
+		return 0, 0, err
+	}
+	return os.FileMode(mode), size, nil
+}
+
+// scpStatus finds the first warning or error in the replies from a
+// receiving scp, which are a status byte -- 0, 1 or 2 for ok, warning
+// or error -- with warnings and errors followed by a message and newline
+func scpStatus(replies string) (int, string) {
+	i := strings.IndexFunc(replies, func(c rune) bool {
+		return c == SCPWarning || c == SCPError
+	})
+	if i < 0 {
+		return 0, ""
+	}
+	msg := replies[i+1:]
+	if j := strings.IndexByte(msg, '\n'); j >= 0 {
+		msg = msg[:j]
+	}
+	return int(replies[i]), msg
+}
+
+// readSCPLine reads a newline terminated scp protocol message.
+// Warnings and errors (leading 1 or 2) are returned as a CmdError
+func readSCPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("scp read failed: %w", err)
+	}
+	line = strings.TrimRight(line, "\n")
+	if len(line) > 0 && line[0] < 3 {
+		return "", CmdError{Stdout: line[1:], SCPLevel: int(line[0]), SCPMessage: line[1:]}
+	}
+	return line, nil
+}
+
+// FetchFile scp's remotePath from the remote host to localPath
+func (s *Connection) FetchFile(remotePath, localPath string) error {
+	f, err := os.Create(localPath)
+	if err != nil {
+		return fmt.Errorf("can't create %q -- %w", localPath, err)
+	}
+	mode, _, err := s.Fetch(remotePath, f)
+	if err != nil {
+		f.Close()
+		os.Remove(localPath)
+		return err
+	}
+	if err := f.Chmod(mode.Perm()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Exec will run a single command in a new session of its own,
+// so a Connection can run any number of commands, in turn or concurrently.
+// Use Run for commands that need the Connection's own session,
+// as set up by Terminal, StreamOutput and the like.
+// The Connection's Environment is set for cmd as RunEnv would
 func (s *Connection) Exec(cmd string) (Results, error) {
-	s.Buffered()
-	return Run(s, cmd)
+	if len(s.Environment) > 0 {
+		return s.RunEnv(cmd, s.Environment)
+	}
+	return s.runSession(cmd)
+}
+
+// RunCombined runs cmd in a session of its own, returning its stdout and
+// stderr combined in the order they arrive, along with its exit code
+func RunCombined(conn *Connection, cmd string) (string, int, error) {
+	done, err := conn.busy()
+	if err != nil {
+		return "", 0, err
+	}
+	defer done()
+	session, cmd, err := conn.envSession(cmd, conn.Environment)
+	if err != nil {
+		return "", 0, err
+	}
+	defer session.Close()
+
+	var out bytes.Buffer
+	w := &lockedWriter{w: &out}
+	session.Stdout = w
+	session.Stderr = w
+	err = exitError(session.Run(cmd))
+	return out.String(), exitCode(err), err
+}
+
+// RunAll runs each of cmds in turn, each in a session of its own, returning
+// the results of those run. With stopOnError, it stops at the first command
+// that fails. Either way, the error is that of the first failure
+func RunAll(conn *Connection, cmds []string, stopOnError bool) ([]Results, error) {
+	var all []Results
+	var first error
+	for _, cmd := range cmds {
+		r, err := conn.Exec(cmd)
+		all = append(all, r)
+		if err != nil && first == nil {
+			first = fmt.Errorf("%s: %w", cmd, err)
+		}
+		if err != nil && stopOnError {
+			break
+		}
+	}
+	return all, first
+}
+
+// RunJSON runs cmd in a session of its own and decodes its stdout,
+// e.g. from `docker inspect`, into a T. A non-zero exit is
+// returned as a CmdError
+func RunJSON[T any](conn *Connection, cmd string) (T, error) {
+	var v T
+	r, err := conn.Exec(cmd)
+	if err != nil {
+		if _, ok := err.(*ssh.ExitError); ok {
+			return v, CmdError{RC: r.RC, Stdout: r.Stdout, Stderr: r.Stderr}
+		}
+		return v, err
+	}
+	if err := json.Unmarshal([]byte(r.Stdout), &v); err != nil {
+		return v, fmt.Errorf("can't decode output of %q -- %w", cmd, err)
+	}
+	return v, nil
+}
+
+// PipeToRemote runs localCmd with its stdout connected to the stdin of
+// remoteCmd, run in a session of its own on conn.
+// This is the equivalent of `localCmd | ssh host remoteCmd`.
+// The first failure from either end is returned, with a remote
+// non-zero exit reported as a CmdError
+func PipeToRemote(localCmd *exec.Cmd, conn *Connection, remoteCmd string) error {
+	done, err := conn.busy()
+	if err != nil {
+		return err
+	}
+	defer done()
+	session, remoteCmd, err := conn.envSession(remoteCmd, conn.Environment)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	w, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	localCmd.Stdout = w
+
+	if err := session.Start(remoteCmd); err != nil {
+		return fmt.Errorf("remote start failed: %w", err)
+	}
+	if err := localCmd.Start(); err != nil {
+		w.Close()
+		return fmt.Errorf("local start failed: %w", err)
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		err := localCmd.Wait()
+		// the remote command won't see EOF until stdin is closed
+		w.Close()
+		if err != nil {
+			err = fmt.Errorf("local command failed: %w", err)
+		}
+		errs <- err
+	}()
+	go func() {
+		err := session.Wait()
+		if _, ok := err.(*ssh.ExitError); ok {
+			err = CmdError{RC: exitCode(err), Stdout: stdout.String(), Stderr: stderr.String()}
+		}
+		errs <- err
+	}()
+
+	var first error
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Grep runs cmd and returns the first line of stdout matching pattern,
+// and whether any line matched.
+// A non-zero exit code is returned as a CmdError unless it is listed in okRC
+func (s *Connection) Grep(cmd string, pattern *regexp.Regexp, okRC ...int) (string, bool, error) {
+	line, ok, _, err := s.GrepOutput(cmd, pattern, okRC...)
+	return line, ok, err
+}
+
+// GrepOutput is Grep that also returns the full results of the command
+func (s *Connection) GrepOutput(cmd string, pattern *regexp.Regexp, okRC ...int) (string, bool, Results, error) {
+	r, err := s.Exec(cmd)
+	if err != nil {
+		if _, ok := err.(*ssh.ExitError); !ok {
+			return "", false, r, err
+		}
+		if !hasCode(okRC, r.RC) {
+			return "", false, r, CmdError{RC: r.RC, Stdout: r.Stdout, Stderr: r.Stderr}
+		}
+	}
+	for _, line := range strings.Split(r.Stdout, "\n") {
+		if pattern.MatchString(line) {
+			return line, true, r, nil
+		}
+	}
+	return "", false, r, nil
+}
+
+// hasCode reports whether rc is one of codes
+func hasCode(codes []int, rc int) bool {
+	for _, c := range codes {
+		if c == rc {
+			return true
+		}
+	}
+	return false
 }
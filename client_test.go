@@ -5,11 +5,28 @@
 package sshclient
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/joho/godotenv"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 const (
@@ -183,4 +200,503 @@ func TestSCP(t *testing.T) {
 	if err != nil {
 		t.Fatal("copy error:", err)
 	}
+	t.Logf("copied via %s", s.LastTransport())
+}
+
+func TestSFTPParallel(t *testing.T) {
+	s, err := DialKeyFile(host, username, keyfile, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.CopyFile(scpTestFile, scpTestDir)
+	if err != nil {
+		t.Fatal("copy error:", err)
+	}
+	remote := scpTestDir + "/" + filepath.Base(scpTestFile)
+	local := filepath.Join(t.TempDir(), "download.txt")
+	if err := s.GetFileParallel(remote, local, 4); err != nil {
+		t.Fatal("download error:", err)
+	}
+	want, err := ioutil.ReadFile(scpTestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("want: %q -- got: %q", want, got)
+	}
+}
+
+func TestSFTPUploadDownload(t *testing.T) {
+	s, err := DialKeyFile(host, username, keyfile, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	client, err := s.SFTP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	content := "uploaded over sftp\n"
+	remote := scpTestDir + "/sftp-upload.txt"
+	if err := client.Upload(strings.NewReader(content), remote, 0644); err != nil {
+		t.Fatal("upload error:", err)
+	}
+	var buf bytes.Buffer
+	if err := client.Download(remote, &buf); err != nil {
+		t.Fatal("download error:", err)
+	}
+	if buf.String() != content {
+		t.Errorf("want: %q -- got: %q", content, buf.String())
+	}
+}
+
+func TestSCPFetch(t *testing.T) {
+	s, err := DialKeyFile(host, username, keyfile, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	remote := scpTestDir + "/" + filepath.Base(scpTestFile)
+	local := filepath.Join(t.TempDir(), "fetched.txt")
+	if err := s.FetchFile(remote, local); err != nil {
+		t.Fatal("fetch error:", err)
+	}
+}
+
+func TestSSHSubsystem(t *testing.T) {
+	s, err := DialKeyFile(host, username, keyfile, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stream, err := s.Subsystem("sftp")
+	if err != nil {
+		t.Fatal("subsystem error:", err)
+	}
+	client, err := sftp.NewClientPipe(stream, stream)
+	if err != nil {
+		t.Fatal("sftp error:", err)
+	}
+	defer client.Close()
+	wd, err := client.Getwd()
+	if err != nil {
+		t.Fatal("getwd error:", err)
+	}
+	t.Log("remote working directory:", wd)
+}
+
+func TestAuthKeyPassphrase(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := x509.MarshalPKCS1PrivateKey(key)
+	passphrase := []byte("open sesame")
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", der, passphrase, x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := pem.EncodeToMemory(block)
+	plain := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der})
+
+	if _, err := AuthKeyBytes(encrypted); err == nil {
+		t.Error("encrypted key parsed without a passphrase")
+	}
+	if _, err := AuthKeyBytesWithPassphrase(encrypted, passphrase); err != nil {
+		t.Error("encrypted key error:", err)
+	}
+	if _, err := AuthKeyBytesWithPassphrase(encrypted, []byte("wrong")); err == nil {
+		t.Error("encrypted key parsed with the wrong passphrase")
+	}
+	if _, err := AuthKeyBytesWithPassphrase(plain, passphrase); err != nil {
+		t.Error("unencrypted key error:", err)
+	}
+}
+
+func TestReadUntilMarker(t *testing.T) {
+	const marker = "__sshclient_0123abcd__"
+	tests := []struct {
+		input, output string
+		rc            int
+	}{
+		{"hello\n\n" + marker + " 0\n", "hello\n", 0},
+		{"no newline\n" + marker + " 1\n", "no newline", 1},
+		{"\n" + marker + " 127\n", "", 127},
+		{"tty\r\n\r\n" + marker + " 2\r\n", "tty\r\n", 2},
+		{"echo " + marker + " 5\nstill going\n\n" + marker + " 3\n", "echo " + marker + " 5\nstill going\n", 3},
+	}
+	for _, tt := range tests {
+		out, rc, err := readUntilMarker(bufio.NewReader(strings.NewReader(tt.input)), marker)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.input, err)
+			continue
+		}
+		if out != tt.output || rc != tt.rc {
+			t.Errorf("%q want: %q %d -- got: %q %d", tt.input, tt.output, tt.rc, out, rc)
+		}
+	}
+	if _, _, err := readUntilMarker(bufio.NewReader(strings.NewReader("partial")), marker); err == nil {
+		t.Error("expected error for output without a marker")
+	}
+}
+
+func TestSSHRunInShell(t *testing.T) {
+	s, err := DialKeyFile(host, username, keyfile, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := RunInShell(s, "cd /tmp"); err != nil {
+		t.Fatal("shell error:", err)
+	}
+	r, err := RunInShell(s, "pwd")
+	if err != nil {
+		t.Fatal("shell error:", err)
+	}
+	if r.RC != 0 || strings.TrimSpace(r.Stdout) != "/tmp" {
+		t.Errorf("want: %q -- got: %q (rc %d)", "/tmp", r.Stdout, r.RC)
+	}
+	r, err = RunInShell(s, "false")
+	if err != nil {
+		t.Fatal("shell error:", err)
+	}
+	if r.RC != 1 {
+		t.Errorf("rc want: 1 -- got: %d", r.RC)
+	}
+}
+
+func TestCannedAnswers(t *testing.T) {
+	answer := cannedAnswers([]string{"hunter2", "123456"})
+	got, err := answer("", "", []string{"Password: "}, []bool{false})
+	if err != nil || len(got) != 1 || got[0] != "hunter2" {
+		t.Errorf("first round want: %q -- got: %q (%v)", "hunter2", got, err)
+	}
+	got, err = answer("", "", []string{"Verification code: "}, []bool{true})
+	if err != nil || len(got) != 1 || got[0] != "123456" {
+		t.Errorf("second round want: %q -- got: %q (%v)", "123456", got, err)
+	}
+	if _, err := answer("", "", []string{"Again: "}, []bool{false}); err == nil {
+		t.Error("expected error once answers ran out")
+	}
+}
+
+func TestSSHForwardLocal(t *testing.T) {
+	s, err := DialKeyFile(host, username, keyfile, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	l, err := s.ForwardLocal("127.0.0.1:0", "localhost:22")
+	if err != nil {
+		t.Fatal("forward error:", err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer conn.Close()
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !strings.HasPrefix(banner, "SSH-") {
+		t.Errorf("unexpected banner: %q", banner)
+	}
+}
+
+func TestSSHForwardRemote(t *testing.T) {
+	s, err := DialKeyFile(host, username, keyfile, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			fmt.Fprint(conn, "hello from here")
+			conn.Close()
+		}
+	}()
+
+	fwd, err := s.ForwardRemote("127.0.0.1:40022", l.Addr().String())
+	if err != nil {
+		t.Fatal("forward error:", err)
+	}
+	defer fwd.Close()
+	r, err := s.Exec("nc 127.0.0.1 40022 </dev/null")
+	if err != nil {
+		t.Fatal("exec error:", err)
+	}
+	if r.Stdout != "hello from here" {
+		t.Errorf("want: %q -- got: %q", "hello from here", r.Stdout)
+	}
+}
+
+func TestSSHJump(t *testing.T) {
+	bastion, err := DialKeyFile(host, username, keyfile, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bastion.Close()
+	auth, err := AuthKeyFile(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	s, err := DialJump(bastion, "localhost", username, config)
+	if err != nil {
+		t.Fatal("jump error:", err)
+	}
+	r, err := s.Exec("logname")
+	s.Close()
+	if err != nil {
+		t.Fatal("exec error:", err)
+	}
+	if strings.TrimSpace(r.Stdout) != username {
+		t.Errorf("want: %q -- got: %q", username, r.Stdout)
+	}
+	// the bastion should still be usable
+	if _, err := bastion.Exec("true"); err != nil {
+		t.Error("bastion error:", err)
+	}
+}
+
+func TestEnvCommand(t *testing.T) {
+	tests := []struct {
+		env  map[string]string
+		want string
+	}{
+		{nil, "make test"},
+		{map[string]string{"GOOS": "linux"}, "env 'GOOS=linux' make test"},
+		{map[string]string{"B": "two words", "A": "it's"}, `env 'A=it'\''s' 'B=two words' make test`},
+	}
+	for _, tt := range tests {
+		if got := envCommand("make test", tt.env); got != tt.want {
+			t.Errorf("%v want: %q -- got: %q", tt.env, tt.want, got)
+		}
+	}
+}
+
+func TestAuthAny(t *testing.T) {
+	home := t.TempDir()
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", "")
+	defer os.Setenv("SSH_AUTH_SOCK", socket)
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	defer os.Setenv("HOME", oldHome)
+
+	password := ssh.Password("secret")
+	if auth := AuthAny(password); len(auth) != 1 {
+		t.Errorf("no credentials available, want 1 method -- got: %d", len(auth))
+	}
+	if _, err := DefaultAuthMethods(); !errors.Is(err, ErrNoAuthMethods) {
+		t.Errorf("no credentials available, want: %v -- got: %v", ErrNoAuthMethods, err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(home, ".ssh", "id_rsa"), pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if auth := AuthAny(password); len(auth) != 2 {
+		t.Errorf("default key available, want 2 methods -- got: %d", len(auth))
+	}
+	if auth, err := DefaultAuthMethods(); err != nil || len(auth) != 1 {
+		t.Errorf("default key available, want 1 method -- got: %d (%v)", len(auth), err)
+	}
+}
+
+func TestDefaultKeysAgent(t *testing.T) {
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", t.TempDir())
+	defer os.Setenv("HOME", oldHome)
+
+	keyring := agent.NewKeyring()
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var dials int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&dials, 1)
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	oldSocket := os.Getenv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", socket)
+	defer os.Setenv("SSH_AUTH_SOCK", oldSocket)
+
+	// an agent with no keys, and no key files, offers nothing
+	if _, err := DefaultAuthMethods(); !errors.Is(err, ErrNoAuthMethods) {
+		t.Errorf("empty agent want: %v -- got: %v", ErrNoAuthMethods, err)
+	}
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DefaultAuthMethods(); err != nil {
+		t.Fatal("agent with a key:", err)
+	}
+	for i := 0; i < 3; i++ {
+		if keys := agentSigners(socket); len(keys) != 1 {
+			t.Errorf("want 1 agent key -- got: %d", len(keys))
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("want the agent dialed once -- got: %d", n)
+	}
+}
+
+func TestExitMissing(t *testing.T) {
+	r := newResults(&ssh.ExitMissingError{}, "", "")
+	if r.RC != -1 || r.Signal != "" {
+		t.Errorf("missing exit status want: rc -1 -- got: rc %d signal %q", r.RC, r.Signal)
+	}
+	if r := newResults(nil, "ok", ""); r.RC != 0 || r.Stdout != "ok" {
+		t.Errorf("success want: rc 0 -- got: %+v", r)
+	}
+	err := exitError(&ssh.ExitMissingError{})
+	if r := newResults(err, "", ""); r.RC != -1 || !errors.Is(err, ErrExitUnknown) {
+		t.Errorf("lost session want: rc -1 %v -- got: rc %d %v", ErrExitUnknown, r.RC, err)
+	}
+	// no command ran, so there's no exit status to be unknown
+	if err := exitError(io.EOF); err != io.EOF {
+		t.Errorf("session failure want: %v -- got: %v", io.EOF, err)
+	}
+	if err := exitError(nil); err != nil {
+		t.Errorf("success want: nil -- got: %v", err)
+	}
+}
+
+func TestWithPort(t *testing.T) {
+	tests := []struct {
+		server, want string
+	}{
+		{"10.0.0.5", "10.0.0.5:22"},
+		{"10.0.0.5:2222", "10.0.0.5:2222"},
+		{"bastion.example.com", "bastion.example.com:22"},
+		{"bastion.example.com:2222", "bastion.example.com:2222"},
+		{"fe80::1", "[fe80::1]:22"},
+		{"[fe80::1]", "[fe80::1]:22"},
+		{"[fe80::1]:2222", "[fe80::1]:2222"},
+	}
+	for _, tt := range tests {
+		if got, err := withPort(tt.server); err != nil || got != tt.want {
+			t.Errorf("%q want: %q -- got: %q (%v)", tt.server, tt.want, got, err)
+		}
+	}
+
+	defer func(port string) { DefaultPort = port }(DefaultPort)
+	DefaultPort = "2222"
+	if got, err := withPort("fe80::1"); err != nil || got != "[fe80::1]:2222" {
+		t.Errorf("want: %q -- got: %q (%v)", "[fe80::1]:2222", got, err)
+	}
+	DefaultPort = ""
+	if got, err := withPort("bastion.example.com"); err == nil {
+		t.Errorf("no port accepted without a default: %q", got)
+	}
+	if got, err := withPort("bastion.example.com:22"); err != nil || got != "bastion.example.com:22" {
+		t.Errorf("want: %q -- got: %q (%v)", "bastion.example.com:22", got, err)
+	}
+}
+
+func TestSCPStatus(t *testing.T) {
+	tests := []struct {
+		replies string
+		level   int
+		msg     string
+	}{
+		{"", 0, ""},
+		{"\x00\x00", 0, ""},
+		{"\x00\x01scp: /opt: Permission denied\n", SCPWarning, "scp: /opt: Permission denied"},
+		{"\x00\x02scp: protocol error\n\x00", SCPError, "scp: protocol error"},
+		{"\x02no newline", SCPError, "no newline"},
+	}
+	for _, tt := range tests {
+		level, msg := scpStatus(tt.replies)
+		if level != tt.level || msg != tt.msg {
+			t.Errorf("%q want: %d %q -- got: %d %q", tt.replies, tt.level, tt.msg, level, msg)
+		}
+	}
+}
+
+func TestAuthCert(t *testing.T) {
+	certFile, keyFile := testCert(t, testCA(t), "deploy")
+	if _, err := AuthCert(certFile, keyFile); err != nil {
+		t.Fatal("cert error:", err)
+	}
+
+	// a certificate for some other key
+	otherCert, _ := testCert(t, testCA(t), "deploy")
+	if _, err := AuthCert(otherCert, keyFile); err == nil {
+		t.Error("certificate accepted with the wrong key")
+	}
+
+	// a bare public key
+	pub := filepath.Join(t.TempDir(), "id_ed25519.pub")
+	cert, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pub, ssh.MarshalAuthorizedKey(parsed.(*ssh.Certificate).Key), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AuthCert(pub, keyFile); err == nil {
+		t.Error("public key accepted as a certificate")
+	}
+}
+
+func TestCloseUnconnected(t *testing.T) {
+	var nilConn *Connection
+	if err := nilConn.Close(); err != nil {
+		t.Error("nil close error:", err)
+	}
+
+	s := &Connection{}
+	if err := s.Close(); err != nil {
+		t.Error("close error:", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Error("second close error:", err)
+	}
 }
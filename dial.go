@@ -0,0 +1,89 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DialOptions gathers the settings for Dial, the zero value of each
+// leaving the ssh package's default in place
+type DialOptions struct {
+	// Timeout limits how long connecting and the handshake may take
+	Timeout time.Duration
+
+	// Auth are the credentials to offer, at least one is required
+	Auth []ssh.AuthMethod
+
+	// HostKeyCallback verifies the server's host key, e.g. one from
+	// KnownHostsFile. If nil, any host key is accepted
+	HostKeyCallback ssh.HostKeyCallback
+
+	// HostKeyAlgorithms are the host key types to accept, in order of preference
+	HostKeyAlgorithms []string
+
+	// BannerCallback is passed the login banner, if the server sends one.
+	// Should it return an error, the connection is abandoned
+	BannerCallback ssh.BannerCallback
+
+	// Ciphers, MACs and KeyExchanges are the algorithms to offer
+	Ciphers      []string
+	MACs         []string
+	KeyExchanges []string
+
+	// LocalAddr, if set, is the address to connect from
+	LocalAddr net.Addr
+
+	// Env becomes the connection's Environment,
+	// set for the commands run on it
+	Env map[string]string
+}
+
+// config returns the ClientConfig the options describe
+func (o DialOptions) config(username string) *ssh.ClientConfig {
+	config := &ssh.ClientConfig{
+		User:              username,
+		Auth:              o.Auth,
+		Timeout:           o.Timeout,
+		HostKeyCallback:   o.HostKeyCallback,
+		HostKeyAlgorithms: o.HostKeyAlgorithms,
+		BannerCallback:    o.BannerCallback,
+	}
+	if config.HostKeyCallback == nil {
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+	WithAlgorithms(o.Ciphers, o.MACs, o.KeyExchanges)(config)
+	return config
+}
+
+// Dial will open an ssh session to server as username, as opts specify
+func Dial(server, username string, opts DialOptions) (*Connection, error) {
+	conn, _, err := DialTimed(server, username, opts)
+	return conn, err
+}
+
+// DialTimings reports where the time went in dialing
+type DialTimings struct {
+	TCPConnect time.Duration // resolving the server's name and connecting to it
+	Handshake  time.Duration // key exchange, authentication and opening the session
+	Total      time.Duration // the whole dial
+}
+
+// DialTimed is Dial, also reporting how long each stage took, e.g. to
+// find the slow hosts in a fleet. Should the dial fail, the timings show
+// how far it got, with Handshake zero if the connect failed
+func DialTimed(server, username string, opts DialOptions) (*Connection, DialTimings, error) {
+	var timings DialTimings
+	conn, err := dialContext(context.Background(), opts.LocalAddr, server, username, opts.config(username), &timings)
+	if err != nil {
+		return nil, timings, err
+	}
+	conn.Environment = opts.Env
+	return conn, timings, nil
+}
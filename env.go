@@ -0,0 +1,106 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SetEnv sets an environment variable for the command run in the
+// connection's session, so it must be called before Run.
+// The remote sshd may refuse it, as AcceptEnv usually restricts
+// which variables a client can set
+func (s *Connection) SetEnv(key, value string) error {
+	return setEnv(s.ssh, key, value)
+}
+
+func setEnv(session *ssh.Session, key, value string) error {
+	if err := session.Setenv(key, value); err != nil {
+		return fmt.Errorf("can't set %s -- %w", key, err)
+	}
+	return nil
+}
+
+// applyEnv sets the connection's Environment in its session
+func (s *Connection) applyEnv() error {
+	for _, key := range envKeys(s.Environment) {
+		if err := s.SetEnv(key, s.Environment[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunEnv runs cmd in a session of its own with env added to its environment.
+// Should the remote sshd refuse to set any of env, cmd is run as
+// `env KEY=VAL ... cmd` instead
+func (s *Connection) RunEnv(cmd string, env map[string]string) (Results, error) {
+	done, err := s.busy()
+	if err != nil {
+		return Results{}, err
+	}
+	defer done()
+	session, cmd, err := s.envSession(cmd, env)
+	if err != nil {
+		return Results{}, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	err = exitError(session.Run(cmd))
+	return newResults(err, stdout.String(), stderr.String()), err
+}
+
+// envSession opens a session of its own to run cmd with env added to its
+// environment, returning cmd as it should be run there. Should the remote
+// sshd refuse to set any of env, that's `env KEY=VAL ... cmd` instead
+func (s *Connection) envSession(cmd string, env map[string]string) (*ssh.Session, string, error) {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return nil, "", err
+	}
+	for _, key := range envKeys(env) {
+		if err := setEnv(session, key, env[key]); err != nil {
+			// the session can't be reused, as the failed request may
+			// have left it in an unknown state, so start afresh
+			session.Close()
+			session, err = s.client.NewSession()
+			if err != nil {
+				return nil, "", err
+			}
+			return session, envCommand(cmd, env), nil
+		}
+	}
+	return session, cmd, nil
+}
+
+// envCommand prefixes cmd with env to set the given variables
+func envCommand(cmd string, env map[string]string) string {
+	if len(env) == 0 {
+		return cmd
+	}
+	args := []string{"env"}
+	for _, key := range envKeys(env) {
+		args = append(args, shellQuote(key+"="+env[key]))
+	}
+	return strings.Join(append(args, cmd), " ")
+}
+
+// envKeys returns the keys of env in sorted order, for repeatable results
+func envKeys(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,180 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Errors returned by this package wrap one of these,
+// so they can be classified with errors.Is
+var (
+	ErrNoAuthMethods    = errors.New("no authentication methods supplied")
+	ErrAgentUnavailable = errors.New("ssh-agent unavailable")
+	ErrHostKeyUnknown   = errors.New("host key unknown")
+	ErrHostKeyMismatch  = errors.New("host key mismatch")
+	ErrTimeout          = errors.New("timeout")
+	ErrCommandFailed    = errors.New("command failed")
+
+	// ErrExitUnknown is returned when a command's exit status couldn't be
+	// determined, e.g. as the session was lost, so it may not have succeeded
+	ErrExitUnknown = errors.New("exit status unknown")
+
+	// Failures to connect, so callers can tell transient ones from the rest.
+	// ErrDialTimeout also matches ErrTimeout
+	ErrAuthFailed      = errors.New("authentication failed")
+	ErrDialTimeout     = fmt.Errorf("dial %w", ErrTimeout)
+	ErrHostUnreachable = errors.New("host unreachable")
+
+	// Authentication failures narrowed down, both matching ErrAuthFailed.
+	// ErrPublicKeyRejected is returned when the server turned down the keys
+	// offered, which it also does for a user it doesn't know, as servers
+	// don't reveal which users exist. ErrNoSupportedMethods is returned when
+	// the server accepts none of the kinds of credentials offered,
+	// e.g. a key where it requires a password
+	ErrPublicKeyRejected  = fmt.Errorf("public key rejected: %w", ErrAuthFailed)
+	ErrNoSupportedMethods = fmt.Errorf("no supported methods: %w", ErrAuthFailed)
+
+	// ErrRemoteDirMissing is returned when a copy's destination
+	// directory doesn't exist on the remote host
+	ErrRemoteDirMissing = errors.New("remote directory missing")
+
+	// ErrSudoPassword is returned by RunSudo when sudo rejects the password
+	ErrSudoPassword = errors.New("sudo password rejected")
+
+	// ErrIdleClosed is returned once a Connection has been closed
+	// for going unused longer than its idle timeout
+	ErrIdleClosed = errors.New("connection idle-closed")
+
+	// ErrPoolClosed is returned by Pool.Get once the Pool is closed
+	ErrPoolClosed = errors.New("pool closed")
+
+	// ErrFileTooLarge is returned when an upload exceeds the connection's MaxFileSize
+	ErrFileTooLarge = errors.New("file exceeds maximum upload size")
+)
+
+// wrapError ties an underlying error to the sentinel error classifying it
+type wrapError struct {
+	kind error
+	err  error
+}
+
+func (e *wrapError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+// Unwrap exposes the underlying error
+func (e *wrapError) Unwrap() error {
+	return e.err
+}
+
+// Is matches the sentinel error, and any sentinel it wraps in turn
+func (e *wrapError) Is(target error) bool {
+	return errors.Is(e.kind, target)
+}
+
+// wrap classifies err as kind, keeping err available via errors.Unwrap
+func wrap(kind, err error) error {
+	return &wrapError{kind: kind, err: err}
+}
+
+// ctxError reports why ctx is done while performing op,
+// classifying a passed deadline as ErrTimeout
+func ctxError(ctx context.Context, op string) error {
+	err := fmt.Errorf("%s: %w", op, ctx.Err())
+	if ctx.Err() == context.DeadlineExceeded {
+		return wrap(ErrTimeout, err)
+	}
+	return err
+}
+
+// classifyDial classifies a failure to connect to the server
+// as ErrDialTimeout or ErrHostUnreachable
+func classifyDial(err error) error {
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return wrap(ErrDialTimeout, err)
+	}
+	var operr *net.OpError
+	if errors.As(err, &operr) {
+		return wrap(ErrHostUnreachable, err)
+	}
+	return err
+}
+
+// AuthError is returned when authentication fails, classified
+// as one of the ErrAuthFailed errors, and matching it with errors.Is
+type AuthError struct {
+	// Attempted are the methods tried, e.g. "publickey", that the server
+	// turned down. The ssh package doesn't report those the server offered,
+	// though any it offered that were supplied will have been tried
+	Attempted []string
+
+	kind error
+	err  error
+}
+
+func (e *AuthError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+// Unwrap exposes the underlying error
+func (e *AuthError) Unwrap() error {
+	return e.err
+}
+
+// Is matches the error's classification
+func (e *AuthError) Is(target error) bool {
+	return errors.Is(e.kind, target)
+}
+
+// attemptedMethods finds the list in the ssh package's
+// "attempted methods [none publickey]" message
+var attemptedMethods = regexp.MustCompile(`attempted methods \[([^\]]*)\]`)
+
+// authError classifies an authentication failure by the methods attempted
+func authError(err error) error {
+	aerr := &AuthError{kind: ErrAuthFailed, err: err}
+	m := attemptedMethods.FindStringSubmatch(err.Error())
+	if m == nil {
+		return aerr
+	}
+	aerr.Attempted = strings.Fields(m[1])
+	offered := false
+	for _, method := range aerr.Attempted {
+		switch method {
+		case "none":
+		case "publickey":
+			aerr.kind = ErrPublicKeyRejected
+			return aerr
+		default:
+			offered = true
+		}
+	}
+	if !offered {
+		aerr.kind = ErrNoSupportedMethods
+	}
+	return aerr
+}
+
+// classifyHandshake marks a handshake failure as an AuthError
+// when the server accepted none of the credentials offered,
+// or gave up on the client for making too many attempts.
+// The ssh package only reports this as text
+func classifyHandshake(err error) error {
+	if msg := err.Error(); strings.Contains(msg, "unable to authenticate") || strings.Contains(msg, "too many authentication failures") {
+		return authError(err)
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return wrap(ErrTimeout, err)
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package sshclient
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCmdErrorIs(t *testing.T) {
+	var err error = CmdError{RC: 1, Stderr: "scp: /nope: No such file or directory"}
+	if !errors.Is(err, ErrCommandFailed) {
+		t.Errorf("%v does not match %v", err, ErrCommandFailed)
+	}
+}
+
+func TestNoAuthMethods(t *testing.T) {
+	_, err := DialSSH("localhost", "nobody", 1)
+	if !errors.Is(err, ErrNoAuthMethods) {
+		t.Errorf("want: %v -- got: %v", ErrNoAuthMethods, err)
+	}
+	_, err = DialSSH("localhost", "nobody", 1, []ssh.AuthMethod{}...)
+	if !errors.Is(err, ErrNoAuthMethods) {
+		t.Errorf("empty slice want: %v -- got: %v", ErrNoAuthMethods, err)
+	}
+	_, err = DialConfigSSH("localhost", "nobody", &ssh.ClientConfig{User: "nobody"})
+	if !errors.Is(err, ErrNoAuthMethods) {
+		t.Errorf("empty config want: %v -- got: %v", ErrNoAuthMethods, err)
+	}
+	_, err = DialConfigSSH("localhost", "nobody", nil)
+	if !errors.Is(err, ErrNoAuthMethods) {
+		t.Errorf("nil config want: %v -- got: %v", ErrNoAuthMethods, err)
+	}
+}
+
+func TestAgentUnavailable(t *testing.T) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", "/nonexistent/agent.sock")
+	defer os.Setenv("SSH_AUTH_SOCK", socket)
+
+	_, err := DialAgent("localhost", "nobody", 1)
+	if !errors.Is(err, ErrAgentUnavailable) {
+		t.Errorf("want: %v -- got: %v", ErrAgentUnavailable, err)
+	}
+}
+
+func TestHostUnreachable(t *testing.T) {
+	// nothing listens on the tcpmux port
+	_, err := DialPassword("localhost:1", "nobody", "secret", 1)
+	if !errors.Is(err, ErrHostUnreachable) {
+		t.Errorf("want: %v -- got: %v", ErrHostUnreachable, err)
+	}
+}
+
+func TestDialTimeoutIs(t *testing.T) {
+	err := wrap(ErrDialTimeout, errors.New("i/o timeout"))
+	if !errors.Is(err, ErrDialTimeout) || !errors.Is(err, ErrTimeout) {
+		t.Errorf("%v should match both %v and %v", err, ErrDialTimeout, ErrTimeout)
+	}
+	if errors.Is(err, ErrHostUnreachable) {
+		t.Errorf("%v should not match %v", err, ErrHostUnreachable)
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	start := time.Now()
+	_, err := DialRetry("localhost:1", "nobody", 1, 3, 10*time.Millisecond, ssh.Password("secret"))
+	if !errors.Is(err, ErrHostUnreachable) {
+		t.Errorf("want: %v -- got: %v", ErrHostUnreachable, err)
+	}
+	// waits of 10ms then 20ms between the attempts
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("gave up without backing off, took %s", elapsed)
+	}
+
+	// a sub-second timeout, as the int seconds of DialRetry can't give
+	opts := DialOptions{Timeout: 250 * time.Millisecond, Auth: []ssh.AuthMethod{ssh.Password("secret")}}
+	_, err = DialRetryOptions(context.Background(), "localhost:1", "nobody", opts, 2, 10*time.Millisecond)
+	if !errors.Is(err, ErrHostUnreachable) || !strings.Contains(err.Error(), "after 2 attempts") {
+		t.Errorf("options want: %v after 2 attempts -- got: %v", ErrHostUnreachable, err)
+	}
+	if _, err := DialRetryOptions(context.Background(), "localhost:1", "nobody", DialOptions{}, 2, 0); !errors.Is(err, ErrNoAuthMethods) {
+		t.Errorf("no auth want: %v -- got: %v", ErrNoAuthMethods, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = DialRetryContext(ctx, "localhost:1", "nobody", 1, 100, time.Second, ssh.Password("secret"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want: %v -- got: %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		attempt int
+		want    time.Duration
+	}{
+		{10 * time.Millisecond, 1, 10 * time.Millisecond},
+		{10 * time.Millisecond, 3, 40 * time.Millisecond},
+		{time.Second, 7, maxBackoff},
+		// shifting this far would overflow
+		{time.Second, 100, maxBackoff},
+		{time.Hour, 1, maxBackoff},
+	}
+	for _, test := range tests {
+		if got := retryWait(test.backoff, test.attempt); got != test.want {
+			t.Errorf("%s attempt %d want: %s -- got: %s", test.backoff, test.attempt, test.want, got)
+		}
+	}
+}
+
+func TestAuthErrorIs(t *testing.T) {
+	tests := []struct {
+		msg       string
+		kind      error
+		attempted []string
+	}{
+		{"ssh: unable to authenticate, attempted methods [none publickey], no supported methods remain", ErrPublicKeyRejected, []string{"none", "publickey"}},
+		{"ssh: unable to authenticate, attempted methods [none], no supported methods remain", ErrNoSupportedMethods, []string{"none"}},
+		{"ssh: unable to authenticate, attempted methods [none password], no supported methods remain", ErrAuthFailed, []string{"none", "password"}},
+		{"ssh: disconnect, reason 2: too many authentication failures", ErrAuthFailed, nil},
+	}
+	for _, test := range tests {
+		err := classifyHandshake(errors.New(test.msg))
+		if !errors.Is(err, test.kind) || !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("%q want: %v -- got: %v", test.msg, test.kind, err)
+		}
+		var aerr *AuthError
+		if !errors.As(err, &aerr) {
+			t.Fatalf("%q not an AuthError: %v", test.msg, err)
+		}
+		if !reflect.DeepEqual(aerr.Attempted, test.attempted) {
+			t.Errorf("%q attempted want: %q -- got: %q", test.msg, test.attempted, aerr.Attempted)
+		}
+	}
+	err := classifyHandshake(errors.New("ssh: unable to authenticate, attempted methods [none password], no supported methods remain"))
+	if errors.Is(err, ErrPublicKeyRejected) || errors.Is(err, ErrNoSupportedMethods) {
+		t.Errorf("password failure misclassified: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"sync"
+)
+
+// HostResult is the outcome of running a command on one of many hosts.
+// Err is set if the host couldn't be dialed, or the command failed
+type HostResult struct {
+	Results Results
+	Err     error
+}
+
+// ExecMany runs cmd on each of hosts as username, dialing them with opts,
+// with no more than concurrency hosts at a time, or all at once if it
+// isn't positive, with opts.Env set for cmd. Each connection is closed
+// once its command is done.
+// The results are keyed by host, as given, so a host listed more
+// than once is only run on once
+func ExecMany(hosts []string, username, cmd string, opts DialOptions, concurrency int) map[string]HostResult {
+	hosts = uniqueHosts(hosts)
+	if concurrency <= 0 {
+		concurrency = len(hosts)
+	}
+	sem := make(chan struct{}, concurrency)
+	results := make(map[string]HostResult, len(hosts))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			var result HostResult
+			conn, err := Dial(host, username, opts)
+			if err != nil {
+				result.Err = err
+			} else {
+				result.Results, result.Err = conn.Exec(cmd)
+				conn.Close()
+			}
+			mu.Lock()
+			results[host] = result
+			mu.Unlock()
+		}(host)
+	}
+	wg.Wait()
+	return results
+}
+
+// uniqueHosts returns hosts without repeats, in the order first given
+func uniqueHosts(hosts []string) []string {
+	seen := make(map[string]bool, len(hosts))
+	unique := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if !seen[host] {
+			seen[host] = true
+			unique = append(unique, host)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,160 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// forwarder accepts connections and proxies each one to a connection
+// from dial. Closing it also closes any connections in progress,
+// and calls done
+type forwarder struct {
+	net.Listener
+	dial func() (net.Conn, error)
+	done func()
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newForwarder(l net.Listener, dial func() (net.Conn, error), done func()) *forwarder {
+	f := &forwarder{
+		Listener: l,
+		dial:     dial,
+		done:     done,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	go f.serve()
+	return f
+}
+
+func (f *forwarder) serve() {
+	for {
+		conn, err := f.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		if f.closed {
+			f.mu.Unlock()
+			conn.Close()
+			return
+		}
+		f.wg.Add(1)
+		f.mu.Unlock()
+		go func() {
+			defer f.wg.Done()
+			remote, err := f.dial()
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if !f.track(conn, remote) {
+				conn.Close()
+				remote.Close()
+				return
+			}
+			proxy(conn, remote)
+			f.untrack(conn, remote)
+		}()
+	}
+}
+
+// track registers active connections, unless the forwarder is closed
+func (f *forwarder) track(conns ...net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	for _, c := range conns {
+		f.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (f *forwarder) untrack(conns ...net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range conns {
+		delete(f.conns, c)
+	}
+}
+
+// Close stops accepting connections, closes those in progress,
+// and waits for their goroutines to exit
+func (f *forwarder) Close() error {
+	err := f.Listener.Close()
+	f.mu.Lock()
+	f.closed = true
+	for c := range f.conns {
+		c.Close()
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+	f.done()
+	return err
+}
+
+// proxy copies between a and b until either side is done, then closes both
+func proxy(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+// ForwardLocal listens on localAddr and forwards each connection it accepts
+// to remoteAddr, as reached from the remote host, like `ssh -L`.
+// Close the returned listener to stop forwarding.
+// The connection counts as in use until then
+func (s *Connection) ForwardLocal(localAddr, remoteAddr string) (net.Listener, error) {
+	done, err := s.busy()
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	return newForwarder(l, func() (net.Conn, error) {
+		return s.client.Dial("tcp", remoteAddr)
+	}, done), nil
+}
+
+// ForwardRemote has the remote host listen on remoteAddr and forwards each
+// connection made to it to localAddr, as reached from here, like `ssh -R`.
+// Close the returned Closer to stop accepting and close the remote listener,
+// the connection counting as in use until then.
+// The remote sshd must permit GatewayPorts to bind a non-loopback address
+func (s *Connection) ForwardRemote(remoteAddr, localAddr string) (io.Closer, error) {
+	done, err := s.busy()
+	if err != nil {
+		return nil, err
+	}
+	l, err := s.client.Listen("tcp", remoteAddr)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	return newForwarder(l, func() (net.Conn, error) {
+		return net.Dial("tcp", localAddr)
+	}, done), nil
+}
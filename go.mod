@@ -1,9 +1,17 @@
 module github.com/paulstuart/sshclient
 
-go 1.15
+go 1.21
 
 require (
 	github.com/creack/pty v1.1.11
 	github.com/joho/godotenv v1.3.0
-	golang.org/x/crypto v0.0.0-20201117144127-c1f2f97bffc9
+	github.com/pkg/sftp v1.13.0
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/term v0.0.0-20201117132131-f5c789dd3221
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/sys v0.0.0-20210119212857-b64e53b001e4 // indirect
 )
@@ -0,0 +1,86 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"sync"
+	"time"
+)
+
+// SetIdleTimeout has the connection closed once it has gone unused for d,
+// replacing any idle timeout already set. Running commands and copying
+// files count as use, and the timer doesn't run while they do. Once idle
+// closed, they fail with ErrIdleClosed. A d of zero turns the timeout off
+func (s *Connection) SetIdleTimeout(d time.Duration) {
+	s.idleMu.Lock()
+	defer s.idleMu.Unlock()
+	s.idleTimeout = d
+	s.idleLast = time.Now()
+	s.resetIdle()
+}
+
+// resetIdle restarts the idle timer, if there's a timeout and the
+// connection is not in use. The caller must hold idleMu
+func (s *Connection) resetIdle() {
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+	if s.idleTimeout > 0 && s.idleBusy == 0 && !s.idleClosed {
+		s.idleTimer = time.AfterFunc(s.idleTimeout, s.idleClose)
+	}
+}
+
+// idleClose closes the connection, unless it was used since the timer started
+func (s *Connection) idleClose() {
+	s.idleMu.Lock()
+	if s.idleBusy > 0 || s.idleTimeout == 0 || time.Since(s.idleLast) < s.idleTimeout {
+		s.idleMu.Unlock()
+		return
+	}
+	s.idleClosed = true
+	s.idleTimer = nil
+	s.idleMu.Unlock()
+	s.Close()
+}
+
+// idleExpired reports whether the connection was closed for going unused
+func (s *Connection) idleExpired() bool {
+	s.idleMu.Lock()
+	defer s.idleMu.Unlock()
+	return s.idleClosed
+}
+
+// stopIdle stops the idle timer for good, as the connection is closing
+func (s *Connection) stopIdle() {
+	s.idleMu.Lock()
+	defer s.idleMu.Unlock()
+	s.idleTimeout = 0
+	s.resetIdle()
+}
+
+// busy marks the connection in use until the returned done is called,
+// or fails with ErrIdleClosed if it was closed for going unused.
+// Only the first call to done counts, so handles that outlive the call
+// that made them can release it from more than one place
+func (s *Connection) busy() (done func(), err error) {
+	s.idleMu.Lock()
+	defer s.idleMu.Unlock()
+	if s.idleClosed {
+		return nil, ErrIdleClosed
+	}
+	s.idleBusy++
+	s.resetIdle()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.idleMu.Lock()
+			defer s.idleMu.Unlock()
+			s.idleBusy--
+			s.idleLast = time.Now()
+			s.resetIdle()
+		})
+	}, nil
+}
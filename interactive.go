@@ -0,0 +1,77 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// Interactive runs a login shell on the remote host attached to the local
+// terminal, like the ssh command does, returning once the shell exits.
+// The remote pty is of type termType, with TERM, LANG and any LC_* variables
+// set to match, which the remote sshd may refuse as with SetEnv.
+// If width or height is zero, the local terminal's size is used,
+// and either way the remote pty follows the local terminal's resizes.
+// The local terminal is in raw mode meanwhile, and restored after
+func (s *Connection) Interactive(termType string, width, height int) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return errors.New("stdin is not a terminal")
+	}
+	if width == 0 || height == 0 {
+		w, h, err := term.GetSize(fd)
+		if err != nil {
+			return err
+		}
+		width, height = w, h
+	}
+	done, err := s.busy()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	// as with ssh's SendEnv, variables the server refuses are left unset
+	s.SetEnv("TERM", termType)
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "LANG=") || strings.HasPrefix(kv, "LC_") {
+			kv := strings.SplitN(kv, "=", 2)
+			s.SetEnv(kv[0], kv[1])
+		}
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 115200,
+		ssh.TTY_OP_OSPEED: 115200,
+	}
+	if err := s.TerminalSize(termType, width, height, modes); err != nil {
+		return err
+	}
+	s.ssh.Stdin = os.Stdin
+	s.ssh.Stdout = os.Stdout
+	s.ssh.Stderr = os.Stderr
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.WatchResize(ctx)
+
+	if err := s.Shell(); err != nil {
+		return err
+	}
+	return exitError(s.ssh.Wait())
+}
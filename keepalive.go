@@ -0,0 +1,96 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultKeepaliveMaxFailures = 3
+
+	// pingTimeout is how long Ping waits for the server to reply
+	pingTimeout = 5 * time.Second
+)
+
+// Keepalive sends a keepalive request to the server every interval,
+// replacing any keepalive already running. Once KeepaliveMaxFailures
+// in a row go unanswered the connection is closed, and the reason is
+// sent on the returned channel. Stop it with StopKeepalive or Close
+func (s *Connection) Keepalive(interval time.Duration) <-chan error {
+	maxFailures := s.KeepaliveMaxFailures
+	if maxFailures <= 0 {
+		maxFailures = defaultKeepaliveMaxFailures
+	}
+	stop := make(chan struct{})
+	s.kaMu.Lock()
+	if s.kaStop != nil {
+		close(s.kaStop)
+	}
+	s.kaStop = stop
+	s.kaMu.Unlock()
+
+	dead := make(chan error, 1)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		failures := 0
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			err := s.keepalive(interval)
+			if err == nil {
+				failures = 0
+				continue
+			}
+			if failures++; failures >= maxFailures {
+				s.client.Close()
+				dead <- fmt.Errorf("connection closed after %d failed keepalives: %w", failures, err)
+				return
+			}
+		}
+	}()
+	return dead
+}
+
+// StopKeepalive stops sending keepalives
+func (s *Connection) StopKeepalive() {
+	s.kaMu.Lock()
+	defer s.kaMu.Unlock()
+	if s.kaStop != nil {
+		close(s.kaStop)
+		s.kaStop = nil
+	}
+}
+
+// Ping checks the connection is still usable by sending the server a
+// keepalive request, without opening a session. It fails if no reply
+// comes within pingTimeout
+func (s *Connection) Ping() error {
+	return s.keepalive(pingTimeout)
+}
+
+// keepalive sends a single keepalive request, waiting up to timeout for
+// the reply. Any reply will do, as servers needn't support the request
+func (s *Connection) keepalive(timeout time.Duration) error {
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := s.client.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-reply:
+		return err
+	case <-timer.C:
+		return wrap(ErrTimeout, errors.New("no reply to keepalive"))
+	}
+}
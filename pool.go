@@ -0,0 +1,158 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Pool keeps a connection per server and user for reuse, so that tools
+// visiting the same hosts over and over needn't dial them each time.
+// Its connections are shared, so use Exec and the other methods that
+// run in a session of their own, and leave closing them to the Pool.
+// Connections are pooled by server and username alone, so whichever
+// DialOptions dialed one apply to all who share it
+type Pool struct {
+	idleTimeout time.Duration
+
+	mu     sync.Mutex
+	conns  map[poolKey]*Connection
+	closed bool
+	stop   chan struct{}
+}
+
+type poolKey struct {
+	server, username string
+}
+
+// NewPool returns an empty Pool. If idleTimeout is positive, connections
+// are given it with SetIdleTimeout, counting from the last Get that
+// returned them, and dropped from the pool once it closes them
+func NewPool(idleTimeout time.Duration) *Pool {
+	p := &Pool{
+		idleTimeout: idleTimeout,
+		conns:       make(map[poolKey]*Connection),
+		stop:        make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		go p.evictIdle()
+	}
+	return p
+}
+
+// Get returns the pooled connection to server as username, provided it
+// still answers a Ping, otherwise it dials a new one with opts
+func (p *Pool) Get(server, username string, opts DialOptions) (*Connection, error) {
+	addr, err := withPort(server)
+	if err != nil {
+		return nil, err
+	}
+	key := poolKey{addr, username}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	pooled := p.conns[key]
+	p.mu.Unlock()
+
+	if pooled != nil {
+		// restarting the idle timeout first means
+		// it can't close the connection once checked
+		p.touch(pooled)
+		if !pooled.idleExpired() && pooled.Ping() == nil {
+			return pooled, nil
+		}
+		p.drop(key, pooled)
+	}
+
+	conn, err := Dial(server, username, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		conn.Close()
+		return nil, ErrPoolClosed
+	}
+	// another caller may have dialed the same host meanwhile
+	if other := p.conns[key]; other != nil && other != pooled && !other.idleExpired() {
+		conn.Close()
+		p.touch(other)
+		return other, nil
+	}
+	p.touch(conn)
+	p.conns[key] = conn
+	return conn, nil
+}
+
+// touch restarts conn's idle timeout, if the pool has one
+func (p *Pool) touch(conn *Connection) {
+	if p.idleTimeout > 0 {
+		conn.SetIdleTimeout(p.idleTimeout)
+	}
+}
+
+// drop closes and forgets conn, if it is still the one pooled for key
+func (p *Pool) drop(key poolKey, conn *Connection) {
+	p.mu.Lock()
+	if p.conns[key] == conn {
+		delete(p.conns, key)
+	}
+	p.mu.Unlock()
+	conn.Close()
+}
+
+// evictIdle periodically forgets connections closed by their idle timeout.
+// The timeout is left to the connections, as they know when they're in use
+func (p *Pool) evictIdle() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			for key, conn := range p.conns {
+				if conn.idleExpired() {
+					delete(p.conns, key)
+				}
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// Len returns how many connections are pooled
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// Close closes all the pooled connections, returning any errors doing so.
+// Get fails with ErrPoolClosed from then on
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.stop)
+	conns := p.conns
+	p.conns = nil
+	p.mu.Unlock()
+	var errs []error
+	for _, conn := range conns {
+		errs = append(errs, conn.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/creack/pty"
+)
+
+// WatchResize keeps the remote pty the same size as the local terminal
+// on stdin, calling WindowChange whenever SIGWINCH reports a resize,
+// until ctx is done. It fails if stdin is not a terminal
+func (s *Connection) WatchResize(ctx context.Context) error {
+	if err := s.matchSize(); err != nil {
+		return err
+	}
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		defer signal.Stop(winch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-winch:
+				s.matchSize()
+			}
+		}
+	}()
+	return nil
+}
+
+// matchSize sets the remote pty to the size of the local terminal
+func (s *Connection) matchSize() error {
+	rows, cols, err := pty.Getsize(os.Stdin)
+	if err != nil {
+		return err
+	}
+	return s.WindowChange(cols, rows)
+}
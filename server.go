@@ -1,15 +1,20 @@
 package sshclient
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/creack/pty"
@@ -22,12 +27,74 @@ type Logger interface {
 	Logf(string, ...interface{})
 }
 
+// FieldLogger is a Logger that can tag what it logs with key-value pairs,
+// as SlogLogger does. The server tags what it logs about a connection
+// with the client's "remote" address, "user" and "channel" type
+type FieldLogger interface {
+	Logger
+	With(args ...interface{}) Logger
+}
+
+// withFields tags what logger logs with args, if it's a FieldLogger
+func withFields(logger Logger, args ...interface{}) Logger {
+	if f, ok := logger.(FieldLogger); ok {
+		return f.With(args...)
+	}
+	return logger
+}
+
 // ExecHandler abstracts handling of ssh "exec"
 type ExecHandler interface {
 	Exec(string) (int, error)
 	SetChannel(ssh.Channel)
 }
 
+// PtyHandler is an ExecHandler that can run commands on the pty
+// a client allocates with "pty-req". SetPty is given nil when
+// the session has no pty
+type PtyHandler interface {
+	ExecHandler
+	SetPty(tty *os.File)
+}
+
+// ShellHandler is an ExecHandler that can also serve "shell" requests,
+// running an interactive shell until the client is done with it.
+// As with Exec, other sessions wait for the handler until then
+type ShellHandler interface {
+	ExecHandler
+	Shell() (int, error)
+}
+
+// ConnHandler is an ExecHandler that is told which connection
+// each command or shell comes from, e.g. to vary its output by user
+type ConnHandler interface {
+	ExecHandler
+	SetConn(ssh.ConnMetadata)
+}
+
+// EnvHandler is an ExecHandler that is given the variables the client
+// set with "env" requests before each command or shell, or nil if none
+type EnvHandler interface {
+	ExecHandler
+	SetEnv(env map[string]string)
+}
+
+// SignalHandler is an ExecHandler that is sent the signals clients
+// deliver with "signal" requests. Signal is called while Exec or Shell
+// is running, so must be safe to call from another goroutine
+type SignalHandler interface {
+	ExecHandler
+	Signal(sig ssh.Signal)
+}
+
+// StreamHandler is an ExecHandler that writes a command's output as it
+// goes, rather than all at once, e.g. to test clients that stream it.
+// ExecStream is called in place of Exec, with w the session's stdout
+type StreamHandler interface {
+	ExecHandler
+	ExecStream(cmd string, w io.Writer) (int, error)
+}
+
 // ServerOptions control the ssh server behavior
 type ServerOptions struct {
 	Hostname string
@@ -38,14 +105,83 @@ type ServerOptions struct {
 	Port     *int
 	Logger   Logger
 	Exec     ExecHandler
+
+	// KeyFiles and HostKeys add further host keys to KeyFile and KeyBytes,
+	// so the server can offer several types, as sshd does
+	KeyFiles []string
+	HostKeys [][]byte
+
+	// ChannelHandlers serve channel types other than "session", such as
+	// "direct-tcpip" for port forwarding, keyed by type. Each is given
+	// the new channel to accept or reject. Other types are rejected
+	ChannelHandlers map[string]func(ssh.NewChannel)
+
+	// Subsystems serve "subsystem" requests, keyed by subsystem name,
+	// with Exec passed the name. Each runs one session at a time,
+	// independently of Exec and the others. Other subsystems are refused
+	Subsystems map[string]ExecHandler
+
+	// Banner, if set, is sent to clients before they authenticate
+	Banner string
+
+	// AuthorizedKeys are public keys, in authorized_keys format,
+	// that Username may log in with
+	AuthorizedKeys [][]byte
+
+	// TrustedCA is a CA public key, in authorized_keys format. Username
+	// may log in with a user certificate it signed naming them as a principal
+	TrustedCA []byte
+
+	// HostCerts are certificates, in authorized_keys format, for host keys.
+	// Each is offered alongside its bare key, for clients that prefer it
+	HostCerts [][]byte
+
+	// HandshakeTimeout, when positive, limits how long a client has to
+	// complete the ssh handshake before it is dropped
+	HandshakeTimeout time.Duration
+
+	// AuthDelay, when positive, delays the response to every password attempt
+	AuthDelay time.Duration
+
+	// FailureDelay, when positive, further delays the response
+	// to password attempts that fail
+	FailureDelay time.Duration
+
+	// MaxAuthTries is how many failed authentication attempts a connection
+	// is allowed before it is dropped, as with sshd's MaxAuthTries.
+	// If zero, the ssh package's default of 6 applies; if negative, any number
+	MaxAuthTries int
+
+	// LockoutAttempts, when positive, is the number of failed password
+	// attempts after which a user is refused, even with the right password
+	LockoutAttempts int
 }
 
+// ErrLockedOut is reported by the server for users that have
+// exceeded ServerOptions.LockoutAttempts
+var ErrLockedOut = errors.New("user locked out")
+
+// Reported by the server for user certificates it rejects
+var (
+	ErrCertUntrusted = errors.New("certificate not signed by a trusted CA")
+	ErrCertExpired   = errors.New("certificate expired or not yet valid")
+	ErrCertPrincipal = errors.New("certificate not valid for user")
+)
+
 // MockHandler allows faking expected behavior
 type MockHandler struct {
 	RC     int
 	Stdout string
 	Stderr string
-	ch     ssh.Channel
+
+	// Delay is how long to wait before any output, e.g. to test timeouts
+	Delay time.Duration
+
+	// DripStdout, if set, is the interval between each byte of Stdout,
+	// written one at a time, e.g. to test streaming
+	DripStdout time.Duration
+
+	ch ssh.Channel
 }
 
 // SetChannel makes this an ExecHandler
@@ -55,11 +191,64 @@ func (m *MockHandler) SetChannel(ch ssh.Channel) {
 
 // Exec makes this an ExecHandler
 func (m *MockHandler) Exec(_ string) (int, error) {
-	fmt.Fprint(m.ch, m.Stdout)
+	time.Sleep(m.Delay)
+	if m.DripStdout > 0 {
+		for i := 0; i < len(m.Stdout); i++ {
+			if i > 0 {
+				time.Sleep(m.DripStdout)
+			}
+			// stop dripping once the client is gone
+			if _, err := m.ch.Write([]byte{m.Stdout[i]}); err != nil {
+				return m.RC, err
+			}
+		}
+	} else {
+		fmt.Fprint(m.ch, m.Stdout)
+	}
 	fmt.Fprint(m.ch.Stderr(), m.Stderr)
 	return m.RC, nil
 }
 
+// RecordingHandler records every command it receives,
+// otherwise behaving like its embedded MockHandler
+type RecordingHandler struct {
+	MockHandler
+	mu       sync.Mutex
+	commands []string
+}
+
+// Exec makes this an ExecHandler
+func (r *RecordingHandler) Exec(cmd string) (int, error) {
+	r.mu.Lock()
+	r.commands = append(r.commands, cmd)
+	r.mu.Unlock()
+	return r.MockHandler.Exec(cmd)
+}
+
+// Commands returns the commands received so far, in order
+func (r *RecordingHandler) Commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.commands...)
+}
+
+// StreamFunc makes a StreamHandler of a function, which is passed
+// each command and the session's stdout to write to as it pleases
+type StreamFunc func(cmd string, w io.Writer) (int, error)
+
+// SetChannel makes this an ExecHandler, though the channel is unused
+func (f StreamFunc) SetChannel(ssh.Channel) {}
+
+// Exec makes this an ExecHandler, but as a StreamHandler it isn't called
+func (f StreamFunc) Exec(cmd string) (int, error) {
+	return 0, errors.New("StreamFunc needs ExecStream")
+}
+
+// ExecStream makes this a StreamHandler
+func (f StreamFunc) ExecStream(cmd string, w io.Writer) (int, error) {
+	return f(cmd, w)
+}
+
 // EchoHandler is the default dummy handler
 type EchoHandler struct {
 	ch ssh.Channel
@@ -78,7 +267,9 @@ func (m *EchoHandler) Exec(cmd string) (int, error) {
 
 // BashHandler runs a command in bash
 type BashHandler struct {
-	ch ssh.Channel
+	ch  ssh.Channel
+	tty *os.File
+	env map[string]string
 }
 
 // SetChannel makes this an ExecHandler
@@ -86,25 +277,189 @@ func (m *BashHandler) SetChannel(ch ssh.Channel) {
 	m.ch = ch
 }
 
-// Exec makes this an ExecHandler
+// SetPty makes this a PtyHandler
+func (m *BashHandler) SetPty(tty *os.File) {
+	m.tty = tty
+}
+
+// SetEnv makes this an EnvHandler
+func (m *BashHandler) SetEnv(env map[string]string) {
+	m.env = env
+}
+
+// bash returns a bash command with the session's environment added
+func (m *BashHandler) bash(args ...string) *exec.Cmd {
+	basher := exec.Command("bash", append([]string{"--noprofile", "--norc"}, args...)...)
+	if len(m.env) > 0 {
+		basher.Env = os.Environ()
+		for _, key := range envKeys(m.env) {
+			basher.Env = append(basher.Env, key+"="+m.env[key])
+		}
+	}
+	return basher
+}
+
+// Exec makes this an ExecHandler. Without a pty, stdout and stderr
+// are kept apart, as sshd does; on a pty they are merged, as a terminal has
+// only the one output
 func (m *BashHandler) Exec(cmd string) (int, error) {
-	basher := exec.Command("bash", "--noprofile", "--norc", "-c", cmd)
+	basher := m.bash("-c", cmd)
+	if m.tty != nil {
+		return m.runOnPty(basher)
+	}
+	return m.runPiped(basher)
+}
 
-	basher.Stdout = m.ch
-	basher.Stderr = m.ch.Stderr()
+// Shell makes this a ShellHandler. Bash runs interactively on the
+// session's pty if it has one, otherwise it reads commands from the channel
+func (m *BashHandler) Shell() (int, error) {
+	basher := m.bash()
+	if m.tty != nil {
+		basher.Args = append(basher.Args, "-i")
+		return m.runOnPty(basher)
+	}
+	return m.runPiped(basher)
+}
 
-	_, err := pty.Start(basher)
+// runPiped runs basher with its stdin, stdout and stderr connected
+// to the channel's, waiting for its output to be sent before returning
+func (m *BashHandler) runPiped(basher *exec.Cmd) (int, error) {
+	stdin, err := basher.StdinPipe()
 	if err != nil {
-		return 0, fmt.Errorf("could not start pty: %w", err)
+		return 0, err
+	}
+	// the relay can outlast this session, by which time
+	// m.ch may be the next one's
+	ch := m.ch
+	basher.Stdout = ch
+	basher.Stderr = ch.Stderr()
+	if err := basher.Start(); err != nil {
+		return 0, fmt.Errorf("could not start bash: %w", err)
+	}
+	// relay stdin ourselves, as exec would wait on the client to close it
+	go func() {
+		io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+	basher.Wait()
+	return exitStatus(basher.ProcessState), nil
+}
+
+// runOnPty runs basher with the session's pty as its controlling
+// terminal, which the server relays to and from the channel
+func (m *BashHandler) runOnPty(basher *exec.Cmd) (int, error) {
+	basher.Stdin = m.tty
+	basher.Stdout = m.tty
+	basher.Stderr = m.tty
+	basher.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err := basher.Start(); err != nil {
+		return 0, fmt.Errorf("could not start bash: %w", err)
+	}
+	basher.Wait()
+	return exitStatus(basher.ProcessState), nil
+}
+
+// exitStatus reports a process's exit code the way bash's $? would,
+// as 128+signal when it was killed by a signal
+func exitStatus(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
 	}
+	return state.ExitCode()
+}
 
-	status, err := basher.Process.Wait()
+// serialHandler runs commands through an ExecHandler one at a time,
+// as the handler's channel is shared by all sessions
+type serialHandler struct {
+	mu sync.Mutex
+	h  ExecHandler
+}
+
+func (s *serialHandler) exec(meta ssh.ConnMetadata, ch ssh.Channel, tty *os.File, env map[string]string, cmd string) (int, error) {
+	return s.run(meta, ch, tty, env, func() (int, error) {
+		if h, ok := s.h.(StreamHandler); ok {
+			return h.ExecStream(cmd, ch)
+		}
+		return s.h.Exec(cmd)
+	})
+}
+
+// canShell reports whether the handler can serve "shell" requests
+func (s *serialHandler) canShell() bool {
+	_, ok := s.h.(ShellHandler)
+	return ok
+}
+
+func (s *serialHandler) shell(meta ssh.ConnMetadata, ch ssh.Channel, tty *os.File, env map[string]string) (int, error) {
+	return s.run(meta, ch, tty, env, func() (int, error) {
+		return s.h.(ShellHandler).Shell()
+	})
+}
+
+// checkUserCert verifies that cert was signed by the checker's CA for
+// user, and is valid now, with a distinct error for each way it fails
+func checkUserCert(checker *ssh.CertChecker, user string, cert *ssh.Certificate) error {
+	if cert.CertType != ssh.UserCert || !checker.IsUserAuthority(cert.SignatureKey) {
+		return fmt.Errorf("certificate %q: %w", cert.KeyId, ErrCertUntrusted)
+	}
+	now := uint64(time.Now().Unix())
+	if now < cert.ValidAfter || now >= cert.ValidBefore {
+		return fmt.Errorf("certificate %q: %w", cert.KeyId, ErrCertExpired)
+	}
+	if err := checker.CheckCert(user, cert); err != nil {
+		if strings.Contains(err.Error(), "principal") {
+			return fmt.Errorf("certificate %q for %q: %w", cert.KeyId, user, ErrCertPrincipal)
+		}
+		return fmt.Errorf("certificate %q: %w", cert.KeyId, err)
+	}
+	return nil
+}
+
+// hostCertSigner returns a signer presenting the certificate in text,
+// for whichever of signers holds its key
+func hostCertSigner(text []byte, signers []ssh.Signer) (ssh.Signer, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(text)
 	if err != nil {
-		return basher.ProcessState.ExitCode(), fmt.Errorf("bash wait error: %w", err)
+		return nil, fmt.Errorf("failed to parse host certificate: %w", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("host certificate is a bare %s key", pub.Type())
 	}
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), cert.Key.Marshal()) {
+			return ssh.NewCertSigner(cert, signer)
+		}
+	}
+	return nil, fmt.Errorf("no host key for certificate %q", cert.KeyId)
+}
 
-	return status.ExitCode(), nil
+// signal passes sig on to the handler, if it takes signals.
+// It doesn't wait for the lock, as the command being signalled holds it
+func (s *serialHandler) signal(sig ssh.Signal) bool {
+	h, ok := s.h.(SignalHandler)
+	if ok {
+		h.Signal(sig)
+	}
+	return ok
+}
 
+// run hands the session's connection, channel, pty and environment
+// to the handler, then calls fn
+func (s *serialHandler) run(meta ssh.ConnMetadata, ch ssh.Channel, tty *os.File, env map[string]string, fn func() (int, error)) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.h.(ConnHandler); ok {
+		c.SetConn(meta)
+	}
+	s.h.SetChannel(ch)
+	if p, ok := s.h.(PtyHandler); ok {
+		p.SetPty(tty)
+	}
+	if e, ok := s.h.(EnvHandler); ok {
+		e.SetEnv(env)
+	}
+	return fn()
 }
 
 type nonlLogger struct{}
@@ -115,8 +470,18 @@ func (n nonlLogger) Log(_ ...interface{}) {}
 // Logf makes this a Logger
 func (n nonlLogger) Logf(_ string, _ ...interface{}) {}
 
-// Server is a fake ssh server for unit testing
-func Server(options *ServerOptions) (func(), error) {
+// Server is a fake ssh server for unit testing,
+// returning the address it listens on and a func to close it
+func Server(options *ServerOptions) (string, func(), error) {
+	srv, err := StartServer(options)
+	if err != nil {
+		return "", nil, err
+	}
+	return srv.Addr(), srv.Close, nil
+}
+
+// StartServer starts a fake ssh server for unit testing
+func StartServer(options *ServerOptions) (*SSHServer, error) {
 	if options.Exec == nil {
 		options.Exec = &EchoHandler{}
 	}
@@ -126,51 +491,127 @@ func Server(options *ServerOptions) (func(), error) {
 	if options.Hostname == "" {
 		options.Hostname = "localhost"
 	}
-	config := &ssh.ServerConfig{}
+	config := &ssh.ServerConfig{MaxAuthTries: options.MaxAuthTries}
+	if options.Banner != "" {
+		config.BannerCallback = func(_ ssh.ConnMetadata) string {
+			return options.Banner
+		}
+	}
 	if options.Password != "" {
+		var mu sync.Mutex
+		failures := make(map[string]int)
 		//Define a function to run when a client attempts a password login
-		config.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+		check := func(c ssh.ConnMetadata, pass []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if options.LockoutAttempts > 0 && failures[c.User()] >= options.LockoutAttempts {
+				return fmt.Errorf("password rejected for %q: %w", c.User(), ErrLockedOut)
+			}
 			// Should use constant-time compare (or better, salt+hash) in a production setting.
 			if c.User() == options.Username && string(pass) == options.Password {
-				return nil, nil
+				return nil
+			}
+			failures[c.User()]++
+			return fmt.Errorf("password rejected for %q", c.User())
+		}
+		config.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if options.AuthDelay > 0 {
+				time.Sleep(options.AuthDelay)
+			}
+			err := check(c, pass)
+			if err != nil && options.FailureDelay > 0 {
+				time.Sleep(options.FailureDelay)
 			}
-			return nil, fmt.Errorf("password rejected for %q", c.User())
+			return nil, err
 		}
 		// You may also explicitly allow anonymous client authentication, though anon bash
 		// sessions may not be a wise idea
 		// NoClientAuth: true,
 	}
 
-	// You can generate a keypair with 'ssh-keygen -t rsa'
-	if options.KeyFile != "" {
-		if strings.HasPrefix(options.KeyFile, "~/") {
-			home, err := os.UserHomeDir()
+	if len(options.AuthorizedKeys) > 0 || len(options.TrustedCA) > 0 {
+		authorized := make(map[string]bool)
+		for _, text := range options.AuthorizedKeys {
+			key, _, _, _, err := ssh.ParseAuthorizedKey(text)
 			if err != nil {
-				return nil, fmt.Errorf("can't find home dir to find `~`: %w", err)
+				return nil, fmt.Errorf("failed to parse authorized key: %w", err)
 			}
-			options.KeyFile = filepath.Join(home, options.KeyFile[2:])
+			authorized[string(key.Marshal())] = true
+		}
+		var checker *ssh.CertChecker
+		if len(options.TrustedCA) > 0 {
+			ca, _, _, _, err := ssh.ParseAuthorizedKey(options.TrustedCA)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse trusted CA: %w", err)
+			}
+			checker = &ssh.CertChecker{
+				IsUserAuthority: func(auth ssh.PublicKey) bool {
+					return bytes.Equal(auth.Marshal(), ca.Marshal())
+				},
+			}
+		}
+		config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if cert, ok := key.(*ssh.Certificate); ok && checker != nil {
+				if err := checkUserCert(checker, c.User(), cert); err != nil {
+					return nil, err
+				}
+				if c.User() == options.Username {
+					return nil, nil
+				}
+			}
+			if c.User() == options.Username && authorized[string(key.Marshal())] {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("%s key %s not authorized for %q", key.Type(), ssh.FingerprintSHA256(key), c.User())
+		}
+	}
+
+	// You can generate a keypair with 'ssh-keygen -t rsa'
+	var signers []ssh.Signer
+	keyFiles := options.KeyFiles
+	if options.KeyFile != "" {
+		keyFiles = append([]string{options.KeyFile}, keyFiles...)
+	}
+	for _, keyFile := range keyFiles {
+		keyFile, err := expandHome(keyFile)
+		if err != nil {
+			return nil, err
 		}
 
-		privateBytes, err := ioutil.ReadFile(options.KeyFile)
+		privateBytes, err := ioutil.ReadFile(keyFile)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load private key (%s): %v", options.KeyFile, err)
+			return nil, fmt.Errorf("failed to load private key (%s): %v", keyFile, err)
 		}
 
 		private, err := ssh.ParsePrivateKey(privateBytes)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse private key: %w", err)
+			return nil, fmt.Errorf("failed to parse private key (%s): %w", keyFile, err)
 		}
 
-		config.AddHostKey(private)
+		signers = append(signers, private)
 	}
 
+	hostKeys := options.HostKeys
 	if len(options.KeyBytes) > 0 {
-		private, err := ssh.ParsePrivateKey(options.KeyBytes)
+		hostKeys = append([][]byte{options.KeyBytes}, hostKeys...)
+	}
+	for _, keyBytes := range hostKeys {
+		private, err := ssh.ParsePrivateKey(keyBytes)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse private key: %w", err)
 		}
 
-		config.AddHostKey(private)
+		signers = append(signers, private)
+	}
+	for _, signer := range signers {
+		config.AddHostKey(signer)
+	}
+	for _, text := range options.HostCerts {
+		signer, err := hostCertSigner(text, signers)
+		if err != nil {
+			return nil, err
+		}
+		config.AddHostKey(signer)
 	}
 
 	// to ensure we can start, by default we'll expect no port to be specified
@@ -185,104 +626,295 @@ func Server(options *ServerOptions) (func(), error) {
 		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
 	*(options.Port) = listener.Addr().(*net.TCPAddr).Port
-	addr = fmt.Sprintf("%s:%d", options.Hostname, *(options.Port))
 
-	listening := true
-	go func() {
-		options.Logger.Logf("Listening on %s...\n", addr)
-		for {
-			tcpConn, err := listener.Accept()
-			if err != nil {
-				if !listening {
-					break
-				}
-				options.Logger.Logf("Failed to accept incoming connection (%s)", err)
-				continue
-			}
-			// Before use, a handshake must be performed on the incoming net.Conn.
-			sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, config)
-			if err != nil {
-				options.Logger.Logf("Failed to handshake (%s)", err)
-				continue
-			}
+	srv := &SSHServer{
+		addr:     fmt.Sprintf("%s:%d", options.Hostname, *(options.Port)),
+		options:  options,
+		config:   config,
+		listener: listener,
+		hndlr:    &serialHandler{h: options.Exec},
+		conns:    make(map[net.Conn]struct{}),
+	}
+	if len(options.Subsystems) > 0 {
+		srv.subsystems = make(map[string]*serialHandler, len(options.Subsystems))
+		for name, h := range options.Subsystems {
+			srv.subsystems[name] = &serialHandler{h: h}
+		}
+	}
+	go srv.serve()
+	return srv, nil
+}
+
+// SSHServer is a fake ssh server started by StartServer
+type SSHServer struct {
+	addr     string
+	options  *ServerOptions
+	config   *ssh.ServerConfig
+	listener net.Listener
+	hndlr    *serialHandler
+
+	subsystems map[string]*serialHandler
 
-			options.Logger.Logf("New SSH connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
-			// Discard all global out-of-band Requests
-			go ssh.DiscardRequests(reqs)
-			// Accept all channels
-			go handleChannels(chans, options.Exec, options.Logger)
+	mu       sync.Mutex
+	closed   bool
+	conns    map[net.Conn]struct{}
+	sessions sync.WaitGroup
+}
+
+// Addr returns the address the server is listening on
+func (srv *SSHServer) Addr() string {
+	return srv.addr
+}
+
+func (srv *SSHServer) serve() {
+	srv.options.Logger.Logf("Listening on %s...\n", srv.addr)
+	for {
+		tcpConn, err := srv.listener.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				break
+			}
+			srv.options.Logger.Logf("Failed to accept incoming connection (%s)", err)
+			continue
 		}
+		go srv.handleConn(tcpConn)
+	}
+}
+
+func (srv *SSHServer) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closed
+}
+
+// stopListening stops accepting new connections and sessions
+func (srv *SSHServer) stopListening() {
+	srv.mu.Lock()
+	srv.closed = true
+	srv.mu.Unlock()
+	srv.options.Logger.Logf("closing listener")
+	srv.listener.Close()
+}
+
+func (srv *SSHServer) closeConns() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for c := range srv.conns {
+		c.Close()
+	}
+}
+
+// Close stops the server, dropping any connections in progress
+func (srv *SSHServer) Close() {
+	srv.stopListening()
+	srv.closeConns()
+}
+
+// Shutdown stops the server accepting connections and sessions, waits for
+// the commands and shells in progress to finish, then closes all connections.
+// Should ctx be done first, the connections are closed regardless
+// and the context's error is returned
+func (srv *SSHServer) Shutdown(ctx context.Context) error {
+	srv.stopListening()
+	done := make(chan struct{})
+	go func() {
+		srv.sessions.Wait()
+		close(done)
 	}()
+	defer srv.closeConns()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// track registers a connection, unless the server is closed
+func (srv *SSHServer) track(conn net.Conn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closed {
+		return false
+	}
+	srv.conns[conn] = struct{}{}
+	return true
+}
+
+func (srv *SSHServer) untrack(conn net.Conn) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.conns, conn)
+}
+
+// startSession counts a new command or shell in progress,
+// unless the server is closed
+func (srv *SSHServer) startSession() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closed {
+		return false
+	}
+	srv.sessions.Add(1)
+	return true
+}
+
+func (srv *SSHServer) handleConn(tcpConn net.Conn) {
+	if !srv.track(tcpConn) {
+		tcpConn.Close()
+		return
+	}
+	defer srv.untrack(tcpConn)
 
-	close := func() {
-		options.Logger.Logf("closing listener")
-		listening = false
-		listener.Close()
+	options := srv.options
+	logger := withFields(options.Logger, "remote", tcpConn.RemoteAddr().String())
+	if options.HandshakeTimeout > 0 {
+		tcpConn.SetDeadline(time.Now().Add(options.HandshakeTimeout))
+	}
+	// Before use, a handshake must be performed on the incoming net.Conn.
+	sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, srv.config)
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			logger.Logf("Handshake timed out for %s after %s", tcpConn.RemoteAddr(), options.HandshakeTimeout)
+			return
+		}
+		logger.Logf("Failed to handshake (%s)", err)
+		return
 	}
-	return close, nil
+	tcpConn.SetDeadline(time.Time{})
+
+	logger = withFields(logger, "user", sshConn.User())
+	logger.Logf("New SSH connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
+	// Discard all global out-of-band Requests
+	go ssh.DiscardRequests(reqs)
+	// Accept all channels
+	go srv.handleChannels(sshConn, chans)
+	sshConn.Wait()
 }
 
-func handleChannels(chans <-chan ssh.NewChannel, hndlr ExecHandler, logger Logger) {
+func (srv *SSHServer) handleChannels(meta ssh.ConnMetadata, chans <-chan ssh.NewChannel) {
 	// Service the incoming Channel channel in go routine
 	for newChannel := range chans {
-		go handleChannel(newChannel, hndlr, logger)
+		go srv.handleChannel(meta, newChannel)
 	}
 }
 
-func handleChannel(newChannel ssh.NewChannel, hndlr ExecHandler, logger Logger) {
+func (srv *SSHServer) handleChannel(meta ssh.ConnMetadata, newChannel ssh.NewChannel) {
+	hndlr := srv.hndlr
+	logger := withFields(srv.options.Logger, "remote", meta.RemoteAddr().String(), "user", meta.User(), "channel", newChannel.ChannelType())
+
+	// At this point, we have the opportunity to reject the client's
+	// request for another logical connection
+	if srv.isClosed() {
+		newChannel.Reject(ssh.Prohibited, "server shutting down")
+		return
+	}
+
 	// Since we're handling a shell, we expect a
 	// channel type of "session". The also describes
 	// "x11", "direct-tcpip" and "forwarded-tcpip"
-	// channel types.
-	if t := newChannel.ChannelType(); t != "session" {
+	// channel types, which are left to ChannelHandlers
+	t := newChannel.ChannelType()
+	if h := srv.options.ChannelHandlers[t]; h != nil && t != "session" {
+		h(newChannel)
+		return
+	}
+	if t != "session" {
 		newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
 		return
 	}
-
-	// At this point, we have the opportunity to reject the client's
-	// request for another logical connection
 	connection, requests, err := newChannel.Accept()
 	if err != nil {
 		logger.Logf("Could not accept channel (%s)", err)
 		return
 	}
-	hndlr.SetChannel(connection)
 
 	// Sessions have out-of-band requests such as "shell", "pty-req" and "env"
 	go func() {
+		var p *sessionPty
+		var env map[string]string
 		for req := range requests {
 			actionOk := true
 			switch req.Type {
 			case "shell":
 				//  only accept the default shell,
 				// (i.e. no command in the Payload)
-				actionOk = len(req.Payload) == 0
-				/*
-					case "pty-req":
-						termLen := req.Payload[3]
-						w, h := parseDims(req.Payload[termLen+4:])
-						SetWinsize(bashf.Fd(), w, h)
-						// Responding true (OK) here will let the client
-						// know we have a pty ready for input
-						req.Reply(true, nil)
-					case "window-change":
-						w, h := parseDims(req.Payload)
-						SetWinsize(bashf.Fd(), w, h)
-				*/
-			case "exec":
-				cmd := string(req.Payload[4:])
-				rc, err := hndlr.Exec(cmd)
-				if err != nil {
-					logger.Logf("handler exec error: %v\n", err)
+				if len(req.Payload) > 0 || !hndlr.canShell() || !srv.startSession() {
 					actionOk = false
+					break
 				}
-				logger.Logf("exec rc: %d\n", rc)
-				_, err = connection.SendRequest("exit-status", false, []byte{0, 0, 0, byte(rc)})
-				if err != nil {
-					logger.Logf("SendRequest error: %+v", err)
+				req.Reply(true, nil)
+				shellEnv := env
+				go srv.execSession(logger, connection, p, func(tty *os.File) (int, error) {
+					return hndlr.shell(meta, connection, tty, shellEnv)
+				})
+				continue
+			case "pty-req":
+				if p != nil {
+					actionOk = false
+					break
 				}
-				req.Reply(actionOk, nil)
-				connection.Close()
+				var err error
+				if p, err = openPty(req.Payload); err != nil {
+					logger.Logf("pty-req error: %v\n", err)
+					actionOk = false
+				}
+			case "window-change":
+				if p != nil && len(req.Payload) >= 8 {
+					w, h := parseDims(req.Payload)
+					SetWinsize(p.ptmx.Fd(), w, h)
+				}
+			case "env":
+				var v struct{ Name, Value string }
+				if err := ssh.Unmarshal(req.Payload, &v); err != nil {
+					actionOk = false
+					break
+				}
+				// copied, as a command already started has the old one
+				next := make(map[string]string, len(env)+1)
+				for k, val := range env {
+					next[k] = val
+				}
+				next[v.Name] = v.Value
+				env = next
+			case "subsystem":
+				// refuse those there are no handlers for, rather than
+				// leave the client waiting on one, as for sftp
+				var name string
+				if len(req.Payload) > 4 {
+					name = string(req.Payload[4:])
+				}
+				sub := srv.subsystems[name]
+				if sub == nil || !srv.startSession() {
+					logger.Logf("subsystem %q refused", name)
+					actionOk = false
+					break
+				}
+				req.Reply(true, nil)
+				subEnv := env
+				go srv.execSession(logger, connection, nil, func(*os.File) (int, error) {
+					return sub.exec(meta, connection, nil, subEnv, name)
+				})
+				continue
+			case "signal":
+				// payload is the signal name, without the "SIG" prefix
+				if len(req.Payload) < 4 || !hndlr.signal(ssh.Signal(req.Payload[4:])) {
+					actionOk = false
+				}
+			case "exec":
+				if !srv.startSession() {
+					actionOk = false
+					break
+				}
+				// like sshd, accept the command before running it,
+				// so the client can start sending it input, and keep
+				// serving requests such as window-change while it runs
+				req.Reply(true, nil)
+				cmd, cmdEnv := string(req.Payload[4:]), env
+				go srv.execSession(logger, connection, p, func(tty *os.File) (int, error) {
+					return hndlr.exec(meta, connection, tty, cmdEnv, cmd)
+				})
+				continue
 
 			default:
 				logger.Logf("unhandled request type: %s\n", req.Type)
@@ -291,10 +923,77 @@ func handleChannel(newChannel ssh.NewChannel, hndlr ExecHandler, logger Logger)
 				req.Reply(actionOk, nil)
 			}
 		}
+		if p != nil {
+			p.Close()
+		}
 		logger.Log("end of session requests")
 	}()
 }
 
+// execSession calls run to have the handler serve the session, reporting
+// its exit status before closing the channel. Given a pty, the handler
+// is expected to use it, with the pty relayed to and from the channel
+func (srv *SSHServer) execSession(logger Logger, ch ssh.Channel, p *sessionPty, run func(tty *os.File) (int, error)) {
+	defer srv.sessions.Done()
+	var tty *os.File
+	var relayed chan struct{}
+	if p != nil {
+		tty = p.tty
+		relayed = make(chan struct{})
+		go func() {
+			io.Copy(ch, p.ptmx)
+			close(relayed)
+		}()
+		go io.Copy(p.ptmx, ch)
+	}
+	rc, err := run(tty)
+	if err != nil {
+		logger.Logf("handler exec error: %v\n", err)
+	}
+	logger.Logf("exec rc: %d\n", rc)
+	if p != nil {
+		// reading the pty fails once nothing has its tty open,
+		// so closing ours lets the relay drain what's left
+		p.tty.Close()
+		<-relayed
+	}
+	_, err = ch.SendRequest("exit-status", false, []byte{0, 0, 0, byte(rc)})
+	if err != nil {
+		logger.Logf("SendRequest error: %+v", err)
+	}
+	ch.Close()
+}
+
+// sessionPty is the pty allocated for a session by "pty-req"
+type sessionPty struct {
+	ptmx, tty *os.File
+}
+
+// openPty allocates a pty sized per the "pty-req" payload:
+// the terminal type followed by its width and height in characters
+func openPty(payload []byte) (*sessionPty, error) {
+	if len(payload) < 4 {
+		return nil, errors.New("malformed pty-req")
+	}
+	termLen := binary.BigEndian.Uint32(payload)
+	if uint32(len(payload)-4) < termLen+8 {
+		return nil, errors.New("malformed pty-req")
+	}
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return nil, fmt.Errorf("could not open pty: %w", err)
+	}
+	w, h := parseDims(payload[4+termLen:])
+	SetWinsize(ptmx.Fd(), w, h)
+	return &sessionPty{ptmx: ptmx, tty: tty}, nil
+}
+
+// Close releases both ends of the pty
+func (p *sessionPty) Close() {
+	p.tty.Close()
+	p.ptmx.Close()
+}
+
 // parseDims extracts terminal dimensions (width x height) from the provided buffer.
 func parseDims(b []byte) (uint32, uint32) {
 	w := binary.BigEndian.Uint32(b)
@@ -1,12 +1,38 @@
 package sshclient
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/creack/pty"
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
 )
 
 const (
@@ -18,36 +44,70 @@ var (
 	testPort int
 )
 
+// testLogger logs to the test until it completes,
+// as server goroutines can outlive it
+type testLogger struct {
+	mu   sync.Mutex
+	t    *testing.T
+	done bool
+}
+
+func newTestLogger(t *testing.T) *testLogger {
+	l := &testLogger{t: t}
+	t.Cleanup(func() {
+		l.mu.Lock()
+		l.done = true
+		l.mu.Unlock()
+	})
+	return l
+}
+
+func (l *testLogger) Log(args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.done {
+		l.t.Log(args...)
+	}
+}
+
+func (l *testLogger) Logf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.done {
+		l.t.Logf(format, args...)
+	}
+}
+
 func testOptions(t *testing.T) *ServerOptions {
 	return &ServerOptions{
 		Username: testUsername,
 		Password: testPassword,
 		Port:     &testPort,
-		Logger:   t,
+		Logger:   newTestLogger(t),
 		KeyFile:  "~/.ssh/id_rsa",
 	}
 }
 
-func testServer(t *testing.T, options *ServerOptions) {
+func testServer(t *testing.T, options *ServerOptions) string {
 	t.Helper()
 	if options == nil {
 		options = testOptions(t)
 	}
-	close, err := Server(options)
+	addr, close, err := Server(options)
 	if err != nil {
 		t.Fatal(err)
 	}
 	t.Cleanup(close)
 	t.Logf("test server running")
+	return addr
 }
 
 func TestLocal(t *testing.T) {
-	testServer(t, nil)
+	host := testServer(t, nil)
 
 	cmd := "hostname"
 	timeout := 5
-	t.Logf("server port is: %d\n", testPort)
-	host := fmt.Sprintf("localhost:%d", testPort)
+	t.Logf("server address is: %s\n", host)
 	r, err := ExecPassword(host, testUsername, testPassword, cmd, timeout)
 	if err != nil {
 		t.Fatal("ssh connect error:", err)
@@ -68,10 +128,9 @@ func TestLocalError(t *testing.T) {
 	rc := 23
 	options := testOptions(t)
 	options.Exec = &MockHandler{RC: rc, Stdout: stdout, Stderr: stderr}
-	testServer(t, options)
+	host := testServer(t, options)
 
 	timeout := 1
-	host := fmt.Sprintf("localhost:%d", testPort)
 	r, err := ExecPassword(host, testUsername, testPassword, cmd, timeout)
 	if err != nil {
 		if err, ok := err.(*ssh.ExitError); ok {
@@ -101,10 +160,9 @@ func TestLocalBash(t *testing.T) {
 	rc := 0
 	options := testOptions(t)
 	options.Exec = &BashHandler{}
-	testServer(t, options)
+	host := testServer(t, options)
 
 	timeout := 1
-	host := fmt.Sprintf("localhost:%d", testPort)
 	r, err := ExecPassword(host, testUsername, testPassword, cmd, timeout)
 	if err != nil {
 		if err, ok := err.(*ssh.ExitError); ok {
@@ -129,14 +187,14 @@ func TestLocalBash(t *testing.T) {
 func TestLocalBashError(t *testing.T) {
 	cmd := "foo" // this should be an invalid command
 	stdout := ""
-	stderr := "bash: foo: command not found\n"
+	// newer versions of bash add "line 1: " after the "bash: "
+	stderr := "foo: command not found\n"
 	rc := 127
 	options := testOptions(t)
 	options.Exec = &BashHandler{}
-	testServer(t, options)
+	host := testServer(t, options)
 
 	timeout := 1
-	host := fmt.Sprintf("localhost:%d", testPort)
 	r, err := ExecPassword(host, testUsername, testPassword, cmd, timeout)
 	if err != nil {
 		if err, ok := err.(*ssh.ExitError); ok {
@@ -153,7 +211,3225 @@ func TestLocalBashError(t *testing.T) {
 	if out != stdout {
 		t.Errorf("stdout want: %q -- got: %q\n", stdout, out)
 	}
-	if r.Stderr != stderr {
-		t.Errorf("stderr want: %q -- got: %q\n", stderr, r.Stderr)
+	if !strings.HasPrefix(r.Stderr, "bash: ") || !strings.HasSuffix(r.Stderr, stderr) {
+		t.Errorf("stderr want: %q -- got: %q\n", "bash: "+stderr, r.Stderr)
+	}
+}
+
+func TestLocalBashStdin(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &BashHandler{}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	s.Buffered()
+
+	r, err := RunStdin(s, "tr a-z A-Z; echo done >&2", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal("run error:", err)
+	}
+	if r.Stdout != "HELLO" || r.Stderr != "done\n" {
+		t.Errorf("want: %q %q -- got: %q %q", "HELLO", "done\n", r.Stdout, r.Stderr)
+	}
+}
+
+func TestLocalMaxFileSize(t *testing.T) {
+	host := testServer(t, nil)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	s.MaxFileSize = 1
+	err = s.CopyFile("testdata/arewethereyet.txt", "/tmp")
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("want: %v -- got: %v", ErrFileTooLarge, err)
+	}
+}
+
+func TestLocalRunFiles(t *testing.T) {
+	stdout := "meh"
+	stderr := "we have a failure to communicate"
+	rc := 3
+	options := testOptions(t)
+	options.Exec = &MockHandler{RC: rc, Stdout: stdout, Stderr: stderr}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	dir := t.TempDir()
+	outFile := filepath.Join(dir, "stdout")
+	errFile := filepath.Join(dir, "stderr")
+	code, err := s.RunFiles("foo", "", outFile, errFile)
+	if _, ok := err.(*ssh.ExitError); !ok {
+		t.Errorf("unexpected error (%T): %v", err, err)
+	}
+	if code != rc {
+		t.Errorf("rc want: %d -- got: %d\n", rc, code)
+	}
+	if b, _ := ioutil.ReadFile(outFile); string(b) != stdout {
+		t.Errorf("stdout want: %q -- got: %q\n", stdout, b)
+	}
+	if b, _ := ioutil.ReadFile(errFile); string(b) != stderr {
+		t.Errorf("stderr want: %q -- got: %q\n", stderr, b)
+	}
+}
+
+func TestLocalDeadline(t *testing.T) {
+	host := testServer(t, nil)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	if err := s.SetDeadline(time.Now()); err != nil {
+		t.Fatal("set deadline error:", err)
+	}
+	if _, err := s.Exec("hostname"); err == nil {
+		t.Error("expected error after deadline passed")
+	}
+}
+
+func TestLocalRecording(t *testing.T) {
+	recorder := &RecordingHandler{MockHandler: MockHandler{Stdout: "ok"}}
+	options := testOptions(t)
+	options.Exec = recorder
+	host := testServer(t, options)
+
+	cmds := []string{"systemctl stop app", "systemctl start app"}
+	for _, cmd := range cmds {
+		r, err := ExecPassword(host, testUsername, testPassword, cmd, 1)
+		if err != nil {
+			t.Fatal("ssh exec error:", err)
+		}
+		if r.Stdout != "ok" {
+			t.Errorf("stdout want: %q -- got: %q\n", "ok", r.Stdout)
+		}
+	}
+	got := recorder.Commands()
+	if strings.Join(got, "\n") != strings.Join(cmds, "\n") {
+		t.Errorf("commands want: %q -- got: %q\n", cmds, got)
+	}
+}
+
+func TestLocalResume(t *testing.T) {
+	const filename = "testdata/arewethereyet.txt"
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &RecordingHandler{MockHandler: MockHandler{Stdout: fmt.Sprintf("%d\n", info.Size())}}
+	options := testOptions(t)
+	options.Exec = recorder
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	s.ResumeIfPresent = true
+	if err := s.CopyFile(filename, "/tmp"); err != nil {
+		t.Fatal("copy error:", err)
+	}
+	if !s.Skipped() {
+		t.Error("upload of matching file was not skipped")
+	}
+	if cmds := recorder.Commands(); len(cmds) != 1 || !strings.Contains(cmds[0], "stat") {
+		t.Errorf("expected a single stat command -- got: %q", cmds)
+	}
+}
+
+func TestLocalGrep(t *testing.T) {
+	stdout := "nginx.service\n   Active: active (running)\n   Tasks: 3\n"
+	options := testOptions(t)
+	options.Exec = &MockHandler{RC: 3, Stdout: stdout}
+	host := testServer(t, options)
+
+	pattern := regexp.MustCompile(`Active: (\w+)`)
+	for _, okRC := range [][]int{nil, {3}} {
+		s, err := DialPassword(host, testUsername, testPassword, 1)
+		if err != nil {
+			t.Fatal("ssh connect error:", err)
+		}
+		line, ok, err := s.Grep("systemctl status nginx", pattern, okRC...)
+		s.Close()
+		if okRC == nil {
+			if !errors.Is(err, ErrCommandFailed) {
+				t.Errorf("want: %v -- got: %v", ErrCommandFailed, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal("grep error:", err)
+		}
+		want := "   Active: active (running)"
+		if !ok || line != want {
+			t.Errorf("want: %q -- got: %q (%t)", want, line, ok)
+		}
+	}
+}
+
+func TestLocalKnownHosts(t *testing.T) {
+	host := testServer(t, nil)
+
+	keyFile, err := expandHome("~/.ssh/id_rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewSignerFromKey(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  ssh.PublicKey
+		want error
+	}{
+		{"known", hostKey.PublicKey(), nil},
+		{"mismatch", otherKey.PublicKey(), ErrHostKeyMismatch},
+		{"unknown", nil, ErrHostKeyUnknown},
+	}
+	for _, tt := range tests {
+		knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+		var line string
+		if tt.key != nil {
+			line = knownhosts.Line([]string{knownhosts.Normalize(host)}, tt.key)
+		}
+		if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		s, err := DialKnownHosts(host, testUsername, knownHosts, 1, ssh.Password(testPassword))
+		if tt.want == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+				continue
+			}
+			s.Close()
+			continue
+		}
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: want: %v -- got: %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestLocalHostKey(t *testing.T) {
+	host := testServer(t, nil)
+
+	// trust on first use
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	key, fingerprint := s.HostKey()
+	line := s.KnownHostsLine()
+	s.Close()
+	if key == nil {
+		t.Fatal("no host key")
+	}
+	if want := ssh.FingerprintSHA256(key); fingerprint != want || !strings.HasPrefix(fingerprint, "SHA256:") {
+		t.Errorf("fingerprint want: %q -- got: %q", want, fingerprint)
+	}
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err = DialKnownHosts(host, testUsername, knownHosts, 1, ssh.Password(testPassword))
+	if err != nil {
+		t.Fatal("recorded host key rejected:", err)
+	}
+	defer s.Close()
+	if again, _ := s.HostKey(); !bytes.Equal(again.Marshal(), key.Marshal()) {
+		t.Error("host key changed between dials")
+	}
+
+	attached, err := AttachSession(s.Client())
+	if err != nil {
+		t.Fatal("attach error:", err)
+	}
+	defer attached.Close()
+	if key, fingerprint := attached.HostKey(); key != nil || fingerprint != "" || attached.KnownHostsLine() != "" {
+		t.Errorf("attached session has a host key: %v %q", key, fingerprint)
+	}
+}
+
+func TestLocalPipeToRemote(t *testing.T) {
+	options := testOptions(t)
+	mock := &MockHandler{}
+	options.Exec = mock
+	host := testServer(t, options)
+
+	tests := []struct {
+		name  string
+		local *exec.Cmd
+		rc    int
+		check func(error) bool
+	}{
+		{"success", exec.Command("true"), 0, func(err error) bool { return err == nil }},
+		{"remote", exec.Command("true"), 2, func(err error) bool { return errors.Is(err, ErrCommandFailed) }},
+		{"local", exec.Command("false"), 0, func(err error) bool {
+			_, ok := errors.Unwrap(err).(*exec.ExitError)
+			return ok
+		}},
+	}
+	for _, tt := range tests {
+		s, err := DialPassword(host, testUsername, testPassword, 1)
+		if err != nil {
+			t.Fatal("ssh connect error:", err)
+		}
+		mock.RC = tt.rc
+		err = PipeToRemote(tt.local, s, "tar x")
+		s.Close()
+		if !tt.check(err) {
+			t.Errorf("%s: unexpected error (%T): %v", tt.name, err, err)
+		}
+	}
+}
+
+func TestLocalHandshakeTimeout(t *testing.T) {
+	options := testOptions(t)
+	options.HandshakeTimeout = 100 * time.Millisecond
+	host := testServer(t, options)
+
+	// connect, but never start the handshake
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// a stalled client must not hold up anyone else
+	r, err := ExecPassword(host, testUsername, testPassword, "hostname", 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	t.Log("client returned:", r.Stdout)
+
+	// the server sends its version, then hangs up once the timeout passes
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("stalled connection was not dropped: %v", err)
+	}
+}
+
+func TestLocalDialContext(t *testing.T) {
+	host := testServer(t, nil)
+	config := &ssh.ClientConfig{
+		User:            testUsername,
+		Auth:            []ssh.AuthMethod{ssh.Password(testPassword)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DialContext(ctx, host, testUsername, config); !errors.Is(err, context.Canceled) {
+		t.Errorf("want: %v -- got: %v", context.Canceled, err)
+	}
+
+	s, err := DialContext(context.Background(), host, testUsername, config)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	s.Close()
+}
+
+func TestLocalRunContext(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &MockHandler{Delay: 2 * time.Second}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = RunContext(ctx, s, "sleep 2")
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrTimeout) {
+		t.Errorf("want: %v -- got: %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("run was not aborted, took %s", elapsed)
+	}
+}
+
+func TestLocalRunTimeout(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &MockHandler{Delay: 2 * time.Second}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	start := time.Now()
+	_, err = RunTimeout(s, "sleep 2", 100*time.Millisecond)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("want: %v -- got: %v", ErrTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("run was not aborted, took %s", elapsed)
+	}
+	if err := s.keepalive(time.Second); err != nil {
+		t.Error("connection closed along with the session:", err)
+	}
+}
+
+func TestLocalDripStdout(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &MockHandler{Stdout: "tick", Stderr: "done", DripStdout: 20 * time.Millisecond}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	chunks := make(chunkWriter, 4)
+	var stderr bytes.Buffer
+	if err := s.StreamOutput(chunks, &stderr); err != nil {
+		t.Fatal("stream error:", err)
+	}
+	start := time.Now()
+	if _, err := Run(s, "tail -f"); err != nil {
+		t.Fatal("run error:", err)
+	}
+	close(chunks)
+	var got []string
+	for chunk := range chunks {
+		got = append(got, chunk)
+	}
+	if want := []string{"t", "i", "c", "k"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want: %q -- got: %q", want, got)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("output arrived all at once, in %v", elapsed)
+	}
+	if stderr.String() != "done" {
+		t.Errorf("stderr want: %q -- got: %q", "done", stderr.String())
+	}
+}
+
+func TestLocalFetch(t *testing.T) {
+	options := testOptions(t)
+	mock := &MockHandler{}
+	options.Exec = mock
+	host := testServer(t, options)
+
+	// fake the source side of the scp protocol
+	content := "hello, world\n"
+	mock.Stdout = fmt.Sprintf("C0640 %d greeting.txt\n%s\x00", len(content), content)
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	local := filepath.Join(t.TempDir(), "greeting.txt")
+	if err := s.FetchFile("/tmp/greeting.txt", local); err != nil {
+		t.Fatal("fetch error:", err)
+	}
+	s.Close()
+	info, err := os.Stat(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("mode want: %o -- got: %o", 0640, info.Mode().Perm())
+	}
+	if b, _ := ioutil.ReadFile(local); string(b) != content {
+		t.Errorf("want: %q -- got: %q", content, b)
+	}
+
+	msg := "scp: /tmp/nope: No such file or directory"
+	mock.Stdout = "\x01" + msg + "\n"
+	mock.RC = 1
+	s, err = DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	_, _, err = s.Fetch("/tmp/nope", ioutil.Discard)
+	var cerr CmdError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("want CmdError -- got (%T): %v", err, err)
+	}
+	if cerr.RC != 1 || cerr.Stdout != msg {
+		t.Errorf("want: rc 1 %q -- got: rc %d %q", msg, cerr.RC, cerr.Stdout)
+	}
+}
+
+func TestLocalBashExitCodes(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &BashHandler{}
+	host := testServer(t, options)
+
+	tests := []struct {
+		cmd string
+		rc  int
+	}{
+		{"exit 3", 3},
+		{"kill -SEGV $$", 128 + int(syscall.SIGSEGV)},
+		{"kill -KILL $$", 128 + int(syscall.SIGKILL)},
+		{"bash -c 'kill -SEGV $$'; exit $?", 128 + int(syscall.SIGSEGV)},
+	}
+	for _, tt := range tests {
+		r, err := ExecPassword(host, testUsername, testPassword, tt.cmd, 1)
+		if _, ok := err.(*ssh.ExitError); !ok {
+			t.Errorf("%q: unexpected error (%T): %v", tt.cmd, err, err)
+		}
+		if r.RC != tt.rc {
+			t.Errorf("%q: rc want: %d -- got: %d", tt.cmd, tt.rc, r.RC)
+		}
+	}
+}
+
+func TestLocalAuthLockout(t *testing.T) {
+	delay := 50 * time.Millisecond
+	options := testOptions(t)
+	options.AuthDelay = delay
+	options.LockoutAttempts = 2
+	host := testServer(t, options)
+
+	start := time.Now()
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	s.Close()
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("auth was not delayed, took %s", elapsed)
+	}
+
+	for i := 0; i < options.LockoutAttempts; i++ {
+		_, err := DialPassword(host, testUsername, "wrong", 1)
+		if err == nil {
+			t.Fatal("bad password accepted")
+		}
+		if !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("want: %v -- got: %v", ErrAuthFailed, err)
+		}
+	}
+	if _, err := DialPassword(host, testUsername, testPassword, 1); err == nil {
+		t.Error("locked out user was let in")
+	}
+}
+
+func TestLocalStreamOutput(t *testing.T) {
+	stdout := "meh"
+	stderr := "we have a failure to communicate"
+	options := testOptions(t)
+	options.Exec = &MockHandler{Stdout: stdout, Stderr: stderr}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	var outBuf, errBuf bytes.Buffer
+	if err := s.StreamOutput(&outBuf, &errBuf); err != nil {
+		t.Fatal("stream error:", err)
+	}
+	r, err := Run(s, "foo")
+	if err != nil {
+		t.Fatal("run error:", err)
+	}
+	if r.Stdout != "" || r.Stderr != "" {
+		t.Errorf("streamed output was also buffered: %+v", r)
+	}
+	if outBuf.String() != stdout {
+		t.Errorf("stdout want: %q -- got: %q\n", stdout, outBuf.String())
+	}
+	if errBuf.String() != stderr {
+		t.Errorf("stderr want: %q -- got: %q\n", stderr, errBuf.String())
+	}
+
+	s.Buffered()
+	if err := s.StreamOutput(&outBuf, &errBuf); err == nil {
+		t.Error("expected error streaming a buffered session")
+	}
+}
+
+// chunkWriter passes on each write it's given
+type chunkWriter chan string
+
+func (c chunkWriter) Write(b []byte) (int, error) {
+	c <- string(b)
+	return len(b), nil
+}
+
+func TestLocalExecStream(t *testing.T) {
+	next := make(chan struct{})
+	options := testOptions(t)
+	options.Exec = StreamFunc(func(cmd string, w io.Writer) (int, error) {
+		fmt.Fprintln(w, "first")
+		<-next
+		fmt.Fprintln(w, "second")
+		return 2, nil
+	})
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	chunks := make(chunkWriter, 2)
+	if err := s.StreamOutput(chunks, ioutil.Discard); err != nil {
+		t.Fatal("stream error:", err)
+	}
+	if err := s.Start("build"); err != nil {
+		t.Fatal("start error:", err)
+	}
+	// the command is still running when its first line arrives
+	select {
+	case chunk := <-chunks:
+		if chunk != "first\n" {
+			t.Errorf("first chunk want: %q -- got: %q", "first\n", chunk)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no output while the command runs")
+	}
+	close(next)
+	r, _ := s.Wait()
+	if r.RC != 2 {
+		t.Errorf("rc want: 2 -- got: %d", r.RC)
+	}
+	if chunk := <-chunks; chunk != "second\n" {
+		t.Errorf("second chunk want: %q -- got: %q", "second\n", chunk)
+	}
+}
+
+// sudoHandler plays sudo -S on a pty, asking for password
+// unless it's empty, then printing the user the command runs as
+type sudoHandler struct {
+	password string
+	delay    time.Duration
+	tty      *os.File
+	ch       ssh.Channel
+}
+
+func (h *sudoHandler) SetChannel(ch ssh.Channel) {
+	h.ch = ch
+}
+
+func (h *sudoHandler) SetPty(tty *os.File) {
+	h.tty = tty
+}
+
+var sudoCommand = regexp.MustCompile(`^sudo -S -p '([^']*)' (.*)$`)
+
+func (h *sudoHandler) Exec(cmd string) (int, error) {
+	m := sudoCommand.FindStringSubmatch(cmd)
+	if m == nil || h.tty == nil {
+		fmt.Fprintf(h.ch.Stderr(), "not sudo on a pty: %q\n", cmd)
+		return 1, nil
+	}
+	if h.password != "" {
+		// the tty's descriptor is used via Control, as Fd would make
+		// it blocking, and closing the pty would no longer end the read
+		rc, err := h.tty.SyscallConn()
+		if err != nil {
+			return 1, err
+		}
+		r := bufio.NewReader(h.tty)
+		for {
+			// like sudo, turn off echo before prompting
+			var state *term.State
+			rc.Control(func(fd uintptr) {
+				state, err = term.MakeRaw(int(fd))
+			})
+			if err != nil {
+				return 1, err
+			}
+			fmt.Fprint(h.tty, m[1])
+			line, err := r.ReadString('\n')
+			rc.Control(func(fd uintptr) {
+				term.Restore(int(fd), state)
+			})
+			if err != nil {
+				return 1, err
+			}
+			if strings.TrimSuffix(line, "\n") == h.password {
+				break
+			}
+			fmt.Fprintln(h.tty, "Sorry, try again.")
+		}
+	}
+	time.Sleep(h.delay)
+	fmt.Fprintf(h.tty, "root ran %s\n", m[2])
+	return 0, nil
+}
+
+func TestLocalRunSudo(t *testing.T) {
+	hndlr := &sudoHandler{password: "hunter2"}
+	options := testOptions(t)
+	options.Exec = hndlr
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	r, err := RunSudo(s, "whoami", "hunter2")
+	if err != nil {
+		t.Fatal("sudo error:", err, r)
+	}
+	if want := "root ran whoami\n"; r.Stdout != want {
+		t.Errorf("want: %q -- got: %q", want, r.Stdout)
+	}
+
+	start := time.Now()
+	r, err = RunSudo(s, "whoami", "wrong")
+	if !errors.Is(err, ErrSudoPassword) {
+		t.Errorf("want: %v -- got: %v (%+v)", ErrSudoPassword, err, r)
+	}
+	if strings.Contains(r.Stdout, "root ran") {
+		t.Errorf("ran with the wrong password: %q", r.Stdout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("wrong password took %v to report", elapsed)
+	}
+
+	// passwordless sudo doesn't prompt
+	hndlr.password = ""
+	r, err = RunSudo(s, "id -u", "unused")
+	if err != nil {
+		t.Fatal("sudo error:", err)
+	}
+	if want := "root ran id -u\n"; r.Stdout != want {
+		t.Errorf("want: %q -- got: %q", want, r.Stdout)
+	}
+}
+
+// catHandler copies its input to its output, like cat
+type catHandler struct {
+	ch ssh.Channel
+}
+
+func (c *catHandler) SetChannel(ch ssh.Channel) {
+	c.ch = ch
+}
+
+func (c *catHandler) Exec(_ string) (int, error) {
+	_, err := io.Copy(c.ch, c.ch)
+	return 0, err
+}
+
+func TestLocalSubsystem(t *testing.T) {
+	next := make(chan struct{})
+	options := testOptions(t)
+	options.Exec = StreamFunc(func(cmd string, w io.Writer) (int, error) {
+		<-next
+		fmt.Fprint(w, "shell done")
+		return 0, nil
+	})
+	options.Subsystems = map[string]ExecHandler{
+		"echo": &catHandler{},
+		"fail": &MockHandler{RC: 3, Stderr: "no such device"},
+	}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	// the connection's session is busy meanwhile
+	s.Buffered()
+	if err := s.Start("shell"); err != nil {
+		t.Fatal("start error:", err)
+	}
+
+	session, err := s.SubsystemSession("echo")
+	if err != nil {
+		t.Fatal("subsystem error:", err)
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(w, "ping")
+	w.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil || string(b) != "ping" {
+		t.Errorf("subsystem want: %q -- got: %q (%v)", "ping", b, err)
+	}
+	session.Close()
+
+	stream, err := s.Subsystem("echo")
+	if err != nil {
+		t.Fatal("subsystem error:", err)
+	}
+	fmt.Fprint(stream, "pong")
+	stream.CloseWrite()
+	b, err = ioutil.ReadAll(stream)
+	if err != nil || string(b) != "pong" {
+		t.Errorf("stream want: %q -- got: %q (%v)", "pong", b, err)
+	}
+	if rc, err := stream.Wait(); rc != 0 || err != nil {
+		t.Errorf("stream exit want: 0 -- got: %d (%v)", rc, err)
+	}
+	stream.Close()
+
+	stream, err = s.Subsystem("fail")
+	if err != nil {
+		t.Fatal("subsystem error:", err)
+	}
+	rc, err := stream.Wait()
+	var cerr CmdError
+	if rc != 3 || !errors.As(err, &cerr) || cerr.RC != 3 {
+		t.Errorf("stream exit want: 3 -- got: %d (%v)", rc, err)
+	}
+	stream.Close()
+	if _, err := s.Subsystem("sftp"); err == nil {
+		t.Error("unknown subsystem accepted")
+	}
+
+	if _, err := s.SubsystemSession("sftp"); err == nil {
+		t.Error("unknown subsystem accepted")
+	}
+
+	close(next)
+	res, err := s.Wait()
+	if err != nil {
+		t.Fatal("shell error:", err)
+	}
+	if res.Stdout != "shell done" {
+		t.Errorf("shell want: %q -- got: %q", "shell done", res.Stdout)
+	}
+}
+
+func TestLocalSlogLogger(t *testing.T) {
+	var logged bytes.Buffer
+	w := &lockedWriter{w: &logged}
+	options := testOptions(t)
+	options.Logger = NewSlogLogger(slog.New(slog.NewJSONHandler(w, nil)))
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	if _, err := s.Exec("hostname"); err != nil {
+		t.Fatal("exec error:", err)
+	}
+	s.Close()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var found bool
+	for _, line := range strings.Split(strings.TrimSpace(logged.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("not structured: %q", line)
+		}
+		if entry["msg"] != "exec rc: 0" {
+			continue
+		}
+		found = true
+		if entry["user"] != testUsername || entry["channel"] != "session" || entry["remote"] == nil {
+			t.Errorf("missing connection fields: %q", line)
+		}
+	}
+	if !found {
+		t.Errorf("exec not logged: %s", logged.String())
+	}
+}
+
+// dropHandler sends some output, then hangs up without an exit status,
+// as when the connection is lost mid-run
+type dropHandler struct {
+	ch ssh.Channel
+}
+
+func (h *dropHandler) SetChannel(ch ssh.Channel) {
+	h.ch = ch
+}
+
+func (h *dropHandler) Exec(_ string) (int, error) {
+	fmt.Fprint(h.ch, "partial out")
+	fmt.Fprint(h.ch.Stderr(), "partial err")
+	return 0, h.ch.Close()
+}
+
+func TestLocalSessionFailure(t *testing.T) {
+	host := testServer(t, nil)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	// the connection's session runs one command only
+	if _, err := Run(s, "uptime"); err != nil {
+		t.Fatal("run error:", err)
+	}
+	if _, err := Run(s, "uptime"); err == nil || errors.Is(err, ErrExitUnknown) {
+		t.Errorf("rerun want: an error other than %v -- got: %v", ErrExitUnknown, err)
+	}
+
+	s.Client().Close()
+	if _, err := s.Exec("uptime"); err == nil || errors.Is(err, ErrExitUnknown) {
+		t.Errorf("closed want: an error other than %v -- got: %v", ErrExitUnknown, err)
+	}
+	if _, _, err := RunCombined(s, "uptime"); err == nil || errors.Is(err, ErrExitUnknown) {
+		t.Errorf("combined want: an error other than %v -- got: %v", ErrExitUnknown, err)
+	}
+}
+
+func TestLocalPartialOutput(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &dropHandler{}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	s.Buffered()
+	r, err := Run(s, "make")
+	if !errors.Is(err, ErrExitUnknown) {
+		t.Errorf("run want: %v -- got: %v", ErrExitUnknown, err)
+	}
+	if r.RC != -1 || r.Stdout != "partial out" || r.Stderr != "partial err" {
+		t.Errorf("run want: rc -1 with the partial output -- got: %+v", r)
+	}
+
+	r, err = s.Exec("make")
+	if !errors.Is(err, ErrExitUnknown) {
+		t.Errorf("exec want: %v -- got: %v", ErrExitUnknown, err)
+	}
+	if r.RC != -1 || r.Stdout != "partial out" || r.Stderr != "partial err" {
+		t.Errorf("exec want: rc -1 with the partial output -- got: %+v", r)
+	}
+
+	out, rc, err := RunCombined(s, "make")
+	if !errors.Is(err, ErrExitUnknown) || rc != -1 {
+		t.Errorf("combined want: rc -1 %v -- got: rc %d %v", ErrExitUnknown, rc, err)
+	}
+	if !strings.Contains(out, "partial out") || !strings.Contains(out, "partial err") {
+		t.Errorf("combined output lost: %q", out)
+	}
+}
+
+func TestLocalRunStdin(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &catHandler{}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	s.Buffered()
+
+	input := "listen = 0.0.0.0:8080\n"
+	r, err := RunStdin(s, "cat > /etc/app.conf", strings.NewReader(input))
+	if err != nil {
+		t.Fatal("run error:", err)
+	}
+	if r.Stdout != input {
+		t.Errorf("want: %q -- got: %q", input, r.Stdout)
+	}
+}
+
+func TestLocalExecReuse(t *testing.T) {
+	recorder := &RecordingHandler{MockHandler: MockHandler{Stdout: "ok"}}
+	options := testOptions(t)
+	options.Exec = recorder
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	cmds := []string{"a", "b", "c"}
+	for _, cmd := range cmds {
+		r, err := s.Exec(cmd)
+		if err != nil {
+			t.Fatalf("exec %q error: %v", cmd, err)
+		}
+		if r.Stdout != "ok" {
+			t.Errorf("stdout want: %q -- got: %q\n", "ok", r.Stdout)
+		}
+	}
+	if got := recorder.Commands(); strings.Join(got, " ") != strings.Join(cmds, " ") {
+		t.Errorf("commands want: %q -- got: %q\n", cmds, got)
+	}
+}
+
+func TestLocalKeepalive(t *testing.T) {
+	host := testServer(t, nil)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	dead := s.Keepalive(10 * time.Millisecond)
+	select {
+	case err := <-dead:
+		t.Fatal("healthy connection reported dead:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// break the transport out from under the keepalive
+	s.SetDeadline(time.Now())
+	select {
+	case err := <-dead:
+		t.Log("connection closed:", err)
+	case <-time.After(time.Second):
+		t.Fatal("dead connection not detected")
+	}
+}
+
+func TestLocalPty(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &BashHandler{}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	if err := s.TerminalSize("xterm", 100, 30, nil); err != nil {
+		t.Fatal("pty error:", err)
+	}
+	s.Buffered()
+	r, err := Run(s, "stty size")
+	if err != nil {
+		t.Fatal("run error:", err)
+	}
+	if got := strings.TrimSpace(r.Stdout); got != "30 100" {
+		t.Errorf("stdout want: %q -- got: %q", "30 100", got)
+	}
+
+	// resize while the command runs
+	s, err = DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	if err := s.TerminalSize("xterm", 100, 30, nil); err != nil {
+		t.Fatal("pty error:", err)
+	}
+	s.Buffered()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.WindowChange(120, 40)
+	}()
+	r, err = Run(s, "sleep 0.5; stty size")
+	if err != nil {
+		t.Fatal("run error:", err)
+	}
+	if got := strings.TrimSpace(r.Stdout); got != "40 120" {
+		t.Errorf("stdout want: %q -- got: %q", "40 120", got)
+	}
+}
+
+func TestLocalPublicKey(t *testing.T) {
+	newKey := func() ([]byte, ssh.PublicKey) {
+		_, key, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), signer.PublicKey()
+	}
+	private, public := newKey()
+	stranger, _ := newKey()
+
+	options := testOptions(t)
+	options.AuthorizedKeys = [][]byte{ssh.MarshalAuthorizedKey(public)}
+	host := testServer(t, options)
+
+	s, err := DialKey(host, testUsername, private, 1)
+	if err != nil {
+		t.Fatal("authorized key rejected:", err)
+	}
+	s.Close()
+
+	if _, err := DialKey(host, testUsername, stranger, 1); !errors.Is(err, ErrPublicKeyRejected) {
+		t.Errorf("unknown key want: %v -- got: %v", ErrPublicKeyRejected, err)
+	}
+	if _, err := DialKey(host, "mallory", private, 1); !errors.Is(err, ErrPublicKeyRejected) {
+		t.Errorf("wrong user want: %v -- got: %v", ErrPublicKeyRejected, err)
+	}
+
+	// a server only taking passwords
+	host = testServer(t, testOptions(t))
+	if _, err := DialKey(host, testUsername, private, 1); !errors.Is(err, ErrNoSupportedMethods) {
+		t.Errorf("password only want: %v -- got: %v", ErrNoSupportedMethods, err)
+	}
+}
+
+func TestLocalShell(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &BashHandler{}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	if _, err := RunInShell(s, "cd /tmp"); err != nil {
+		t.Fatal("shell error:", err)
+	}
+	r, err := RunInShell(s, "pwd")
+	if err != nil {
+		t.Fatal("shell error:", err)
+	}
+	if got := strings.TrimSpace(r.Stdout); r.RC != 0 || got != "/tmp" {
+		t.Errorf("want: %q -- got: %q (rc %d)", "/tmp", got, r.RC)
+	}
+	r, err = RunInShell(s, "false")
+	if err != nil {
+		t.Fatal("shell error:", err)
+	}
+	if r.RC != 1 {
+		t.Errorf("rc want: 1 -- got: %d", r.RC)
+	}
+}
+
+func TestLocalShellUnsupported(t *testing.T) {
+	host := testServer(t, nil)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	if err := s.Shell(); err == nil {
+		t.Error("shell accepted by a handler that can't run one")
+	}
+}
+
+func TestLocalShutdown(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &MockHandler{Delay: 300 * time.Millisecond}
+	srv, err := StartServer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+
+	s, err := DialPassword(srv.Addr(), testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Exec("sleep")
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Error("shutdown error:", err)
+	}
+	if err := <-done; err != nil {
+		t.Error("session in progress was cut short:", err)
+	}
+	if _, err := DialPassword(srv.Addr(), testUsername, testPassword, 1); err == nil {
+		t.Error("connected after shutdown")
+	}
+}
+
+func TestLocalShutdownTimeout(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &MockHandler{Delay: 2 * time.Second}
+	srv, err := StartServer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+
+	s, err := DialPassword(srv.Addr(), testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	go s.Exec("sleep")
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want: %v -- got: %v", context.DeadlineExceeded, err)
+	}
+}
+
+// tenantHandler answers with who it is serving
+type tenantHandler struct {
+	MockHandler
+	meta ssh.ConnMetadata
+}
+
+func (h *tenantHandler) SetConn(meta ssh.ConnMetadata) {
+	h.meta = meta
+}
+
+func (h *tenantHandler) Exec(cmd string) (int, error) {
+	host, _, _ := net.SplitHostPort(h.meta.RemoteAddr().String())
+	fmt.Fprintf(h.ch, "%s@%s", h.meta.User(), host)
+	return 0, nil
+}
+
+func TestLocalConnHandler(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &tenantHandler{}
+	host := testServer(t, options)
+
+	r, err := ExecPassword(host, testUsername, testPassword, "whoami", 1)
+	if err != nil {
+		t.Fatal("ssh exec error:", err)
+	}
+	if want := testUsername + "@127.0.0.1"; r.Stdout != want {
+		t.Errorf("stdout want: %q -- got: %q", want, r.Stdout)
+	}
+}
+
+// testHostKeys generates an ed25519 and an RSA host key
+func testHostKeys(t *testing.T) [][]byte {
+	_, edKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return [][]byte{
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}),
+	}
+}
+
+// testCert writes a new key, and a certificate for it signed by ca
+// for principal, returning the files' names
+func testCert(t *testing.T, ca ssh.Signer, principal string) (certFile, keyFile string) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		KeyId:           principal,
+		ValidPrincipals: []string{principal},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	keyFile = filepath.Join(dir, "id_ed25519")
+	certFile = keyFile + "-cert.pub"
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// testCA returns a new signer to act as an ssh CA
+func testCA(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func TestLocalHostKeys(t *testing.T) {
+	options := testOptions(t)
+	options.KeyFile = ""
+	options.HostKeys = testHostKeys(t)
+	host := testServer(t, options)
+
+	for _, algo := range []string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSA} {
+		var got string
+		config := &ssh.ClientConfig{
+			User:              testUsername,
+			Auth:              []ssh.AuthMethod{ssh.Password(testPassword)},
+			HostKeyAlgorithms: []string{algo},
+			HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+				got = key.Type()
+				return nil
+			},
+		}
+		s, err := DialConfigSSH(host, testUsername, config)
+		if err != nil {
+			t.Errorf("%s: ssh connect error: %v", algo, err)
+			continue
+		}
+		s.Close()
+		if got != algo {
+			t.Errorf("host key want: %s -- got: %s", algo, got)
+		}
+	}
+}
+
+// scpSink plays the receiving end of scp, keeping the file it's sent,
+// and the sending end, sending that file back.
+// If dirs is set, only targets in it exist, and `mkdir -p` adds to it.
+// Other commands are echoed back
+type scpSink struct {
+	ch     ssh.Channel
+	cmd    string
+	target string
+	name   string
+	mode   os.FileMode
+	data   []byte
+	dirs   map[string]bool
+}
+
+func (h *scpSink) SetChannel(ch ssh.Channel) {
+	h.ch = ch
+}
+
+func (h *scpSink) Exec(cmd string) (int, error) {
+	if h.dirs != nil && strings.HasPrefix(cmd, "mkdir -p ") {
+		h.dirs[strings.Trim(cmd[len("mkdir -p "):], "'")] = true
+		return 0, nil
+	}
+	if strings.Contains(cmd, "scp -fq ") {
+		h.cmd = cmd
+		return h.send()
+	}
+	if !strings.Contains(cmd, "scp -tq ") {
+		fmt.Fprint(h.ch, cmd)
+		return 0, nil
+	}
+	h.cmd = cmd
+	h.target = cmd[strings.LastIndex(cmd, " ")+1:]
+	r := bufio.NewReader(h.ch)
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return 1, err
+	}
+	var size int64
+	if _, err := fmt.Sscanf(header, "C%o %d %s", &h.mode, &size, &h.name); err != nil {
+		return 1, err
+	}
+	h.data = make([]byte, size)
+	if _, err := io.ReadFull(r, h.data); err != nil {
+		return 1, err
+	}
+	if b, err := r.ReadByte(); err != nil || b != 0 {
+		return 1, fmt.Errorf("no end of file marker: %v", err)
+	}
+	if h.dirs != nil && !h.dirs[h.target] {
+		fmt.Fprintf(h.ch, "\x00\x01scp: %s/%s: No such file or directory\n", h.target, h.name)
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// send plays scp -f, sending the file last received
+func (h *scpSink) send() (int, error) {
+	r := bufio.NewReader(h.ch)
+	ack := func() error {
+		b, err := r.ReadByte()
+		if err == nil && b != 0 {
+			err = fmt.Errorf("bad ack: %d", b)
+		}
+		return err
+	}
+	if err := ack(); err != nil {
+		return 1, err
+	}
+	fmt.Fprintf(h.ch, "C%04o %d %s\n", h.mode, len(h.data), h.name)
+	if err := ack(); err != nil {
+		return 1, err
+	}
+	h.ch.Write(append(h.data, 0))
+	if err := ack(); err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
+
+func TestLocalWriteFile(t *testing.T) {
+	sink := &scpSink{}
+	options := testOptions(t)
+	options.Exec = sink
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	content := []byte("listen = 0.0.0.0:8080\n")
+	if err := s.WriteFile(content, "/etc/app.conf", 0640); err != nil {
+		t.Fatal("write error:", err)
+	}
+	if sink.target != "/etc/" || sink.name != "app.conf" || sink.mode != 0640 {
+		t.Errorf("want: /etc/ app.conf 0640 -- got: %s %s %#o", sink.target, sink.name, sink.mode)
+	}
+	if string(sink.data) != string(content) {
+		t.Errorf("content want: %q -- got: %q", content, sink.data)
+	}
+}
+
+func TestLocalCopyWithProgress(t *testing.T) {
+	sink := &scpSink{}
+	options := testOptions(t)
+	options.Exec = sink
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	size := int64(len(content))
+	var calls int
+	var written, total int64
+	err = s.CopyWithProgress(bytes.NewReader(content), "image.bin", "/tmp", size, 0644, func(w, t int64) {
+		calls++
+		written, total = w, t
+	})
+	if err != nil {
+		t.Fatal("copy error:", err)
+	}
+	if written != size || total != size {
+		t.Errorf("final progress want: %d/%d -- got: %d/%d", size, size, written, total)
+	}
+	// one per read would be hundreds
+	if calls > 10 {
+		t.Errorf("progress reported too often: %d times", calls)
+	}
+	if len(sink.data) != len(content) {
+		t.Errorf("received %d bytes, want %d", len(sink.data), len(content))
+	}
+}
+
+func TestLocalScpCommand(t *testing.T) {
+	sink := &scpSink{}
+	options := testOptions(t)
+	options.Exec = sink
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	if err := s.Copy(strings.NewReader("payload"), "app.conf", "/etc", 7, 0644); err != nil {
+		t.Fatal("copy error:", err)
+	}
+	if want := DefaultScpCommand + " -tq /etc"; sink.cmd != want {
+		t.Errorf("want: %q -- got: %q", want, sink.cmd)
+	}
+
+	s.ScpCommand = "sudo /opt/bin/scp"
+	if err := s.Copy(strings.NewReader("payload"), "app.conf", "/etc", 7, 0644); err != nil {
+		t.Fatal("copy error:", err)
+	}
+	if want := "sudo /opt/bin/scp -tq /etc"; sink.cmd != want {
+		t.Errorf("want: %q -- got: %q", want, sink.cmd)
+	}
+	var b bytes.Buffer
+	if _, _, err := s.Fetch("/etc/app.conf", &b); err != nil {
+		t.Fatal("fetch error:", err)
+	}
+	if want := "sudo /opt/bin/scp -fq /etc/app.conf"; sink.cmd != want {
+		t.Errorf("want: %q -- got: %q", want, sink.cmd)
+	}
+}
+
+func TestLocalCopyKeepsStreaming(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &scpSink{}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	var stdout, stderr bytes.Buffer
+	if err := s.StreamOutput(&stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteFile([]byte("data"), "/tmp/data.txt", 0644); err != nil {
+		t.Fatal("write error:", err)
+	}
+	if _, err := Run(s, "uptime"); err != nil {
+		t.Fatal("run error:", err)
+	}
+	if stdout.String() != "uptime" {
+		t.Errorf("streamed stdout want: %q -- got: %q", "uptime", stdout.String())
+	}
+}
+
+func TestLocalDialRetryAuth(t *testing.T) {
+	host := testServer(t, nil)
+
+	start := time.Now()
+	_, err := DialRetry(host, testUsername, 1, 5, time.Second, ssh.Password("wrong"))
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("want: %v -- got: %v", ErrAuthFailed, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("auth failure was retried, took %s", elapsed)
+	}
+}
+
+func TestLocalDialFrom(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &tenantHandler{}
+	testServer(t, options)
+	host := fmt.Sprintf("127.0.0.1:%d", testPort)
+	config := dialConfig(testUsername, 1, []ssh.AuthMethod{ssh.Password(testPassword)})
+
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	s, err := DialConfigSSHFrom(local, host, testUsername, config)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	r, err := s.Exec("whoami")
+	if err != nil {
+		t.Fatal("ssh exec error:", err)
+	}
+	if want := testUsername + "@127.0.0.1"; r.Stdout != want {
+		t.Errorf("stdout want: %q -- got: %q", want, r.Stdout)
+	}
+
+	// TEST-NET-1 is never assigned locally
+	unassigned := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	if _, err := DialConfigSSHFrom(unassigned, host, testUsername, config); err == nil {
+		t.Error("dialed from an address that isn't ours")
+	}
+}
+
+func TestLocalAccessors(t *testing.T) {
+	host := testServer(t, nil)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	if s.Client() == nil || s.Session() == nil {
+		t.Fatal("accessors returned nil")
+	}
+	session, err := s.Client().NewSession()
+	if err != nil {
+		t.Fatal("new session error:", err)
+	}
+	defer session.Close()
+	out, err := session.Output("hostname")
+	if err != nil {
+		t.Fatal("run error:", err)
+	}
+	if want := `command is: "hostname"`; string(out) != want {
+		t.Errorf("want: %q -- got: %q", want, out)
+	}
+}
+
+func TestLocalAttachSession(t *testing.T) {
+	host := testServer(t, nil)
+
+	config := &ssh.ClientConfig{
+		User:            testUsername,
+		Auth:            []ssh.AuthMethod{ssh.Password(testPassword)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	client, err := ssh.Dial("tcp", host, config)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer client.Close()
+
+	a, err := AttachSession(client)
+	if err != nil {
+		t.Fatal("attach error:", err)
+	}
+	b, err := AttachSession(client)
+	if err != nil {
+		t.Fatal("attach error:", err)
+	}
+	defer b.Close()
+
+	if err := a.Close(); err != nil {
+		t.Error("close error:", err)
+	}
+	r, err := b.Exec("hostname")
+	if err != nil {
+		t.Fatal("shared client closed with its session:", err)
+	}
+	if want := `command is: "hostname"`; r.Stdout != want {
+		t.Errorf("want: %q -- got: %q", want, r.Stdout)
+	}
+}
+
+func TestLocalExecConcurrent(t *testing.T) {
+	host := testServer(t, nil)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cmd := fmt.Sprintf("echo %d", i)
+			r, err := s.Exec(cmd)
+			if err != nil {
+				t.Errorf("%s: exec error: %v", cmd, err)
+				return
+			}
+			if want := fmt.Sprintf("command is: %q", cmd); r.Stdout != want {
+				t.Errorf("want: %q -- got: %q", want, r.Stdout)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestLocalPing(t *testing.T) {
+	host := testServer(t, nil)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	if err := s.Ping(); err != nil {
+		t.Error("ping error:", err)
+	}
+	s.Client().Close()
+	if err := s.Ping(); err == nil {
+		t.Error("ping succeeded on a closed connection")
+	}
+}
+
+func TestLocalNewClientConn(t *testing.T) {
+	host := testServer(t, nil)
+
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := dialConfig(testUsername, 1, []ssh.AuthMethod{ssh.Password(testPassword)})
+	s, err := NewClientConn(conn, host, config)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	r, err := s.Exec("hostname")
+	if err != nil {
+		t.Fatal("ssh exec error:", err)
+	}
+	if want := `command is: "hostname"`; r.Stdout != want {
+		t.Errorf("want: %q -- got: %q", want, r.Stdout)
+	}
+}
+
+func TestLocalRunAll(t *testing.T) {
+	recorder := &RecordingHandler{MockHandler: MockHandler{RC: 1}}
+	options := testOptions(t)
+	options.Exec = recorder
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	cmds := []string{"apt-get update", "apt-get install -y nginx", "systemctl start nginx"}
+	results, err := RunAll(s, cmds, true)
+	if err == nil {
+		t.Error("expected the failure to be reported")
+	}
+	if len(results) != 1 || results[0].RC != 1 {
+		t.Errorf("want the first result only -- got: %+v", results)
+	}
+
+	results, err = RunAll(s, cmds, false)
+	if err == nil {
+		t.Error("expected the failure to be reported")
+	}
+	if len(results) != len(cmds) {
+		t.Errorf("want %d results -- got: %d", len(cmds), len(results))
+	}
+	if got := recorder.Commands(); len(got) != 1+len(cmds) {
+		t.Errorf("want %d commands run -- got: %q", 1+len(cmds), got)
+	}
+}
+
+func TestLocalCombined(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &MockHandler{RC: 2, Stdout: "compiling\n", Stderr: "main.go:3: syntax error\n"}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	out, rc, err := RunCombined(s, "make")
+	if err == nil || rc != 2 {
+		t.Errorf("want rc 2 with an error -- got: rc %d (%v)", rc, err)
+	}
+	if !strings.Contains(out, "compiling\n") || !strings.Contains(out, "syntax error") {
+		t.Errorf("combined output missing a stream: %q", out)
+	}
+
+	s.Combined()
+	r, _ := Run(s, "make")
+	if r.Stderr != "" || !strings.Contains(r.Stdout, "compiling\n") || !strings.Contains(r.Stdout, "syntax error") {
+		t.Errorf("want all output in stdout -- got: %+v", r)
+	}
+}
+
+// agentHandler reports how many keys the client's forwarded agent holds
+type agentHandler struct {
+	MockHandler
+	conn ssh.Conn
+}
+
+func (h *agentHandler) SetConn(meta ssh.ConnMetadata) {
+	h.conn = meta.(ssh.Conn)
+}
+
+func (h *agentHandler) Exec(_ string) (int, error) {
+	ch, reqs, err := h.conn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		return 1, err
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	keys, err := agent.NewClient(ch).List()
+	if err != nil {
+		return 1, err
+	}
+	fmt.Fprint(h.ch, len(keys))
+	return 0, nil
+}
+
+func TestLocalForwardAgent(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	oldSocket := os.Getenv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", socket)
+	defer os.Setenv("SSH_AUTH_SOCK", oldSocket)
+
+	options := testOptions(t)
+	options.Exec = &agentHandler{}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	if err := s.ForwardAgent(); err != nil {
+		t.Fatal("forward agent error:", err)
+	}
+	s.Buffered()
+	r, err := Run(s, "ssh-add -l")
+	if err != nil {
+		t.Fatal("run error:", err)
+	}
+	if r.Stdout != "1" {
+		t.Errorf("forwarded keys want: 1 -- got: %q", r.Stdout)
+	}
+}
+
+func TestLocalWithAlgorithms(t *testing.T) {
+	host := testServer(t, nil)
+	config := dialConfig(testUsername, 1, []ssh.AuthMethod{ssh.Password(testPassword)})
+
+	s, err := DialConfigSSH(host, testUsername, config, WithAlgorithms([]string{"aes128-ctr"}, []string{"hmac-sha2-256"}, nil))
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	s.Close()
+
+	// the server's defaults leave out legacy CBC ciphers
+	if _, err := DialConfigSSH(host, testUsername, config, WithAlgorithms([]string{"aes128-cbc"}, nil, nil)); err == nil {
+		t.Error("connected with a cipher the server doesn't support")
+	}
+	if len(config.Ciphers) > 0 {
+		t.Errorf("caller's config was modified: %q", config.Ciphers)
+	}
+}
+
+func TestLocalPreferHostKeyAlgos(t *testing.T) {
+	options := testOptions(t)
+	options.KeyFile = ""
+	options.HostKeys = testHostKeys(t)
+	host := testServer(t, options)
+
+	var got string
+	config := dialConfig(testUsername, 1, []ssh.AuthMethod{ssh.Password(testPassword)})
+	config.HostKeyCallback = func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		got = key.Type()
+		return nil
+	}
+	s, err := DialConfigSSH(host, testUsername, config, PreferHostKeyAlgos(ssh.KeyAlgoRSA, ssh.KeyAlgoED25519))
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	s.Close()
+	if got != ssh.KeyAlgoRSA {
+		t.Errorf("host key want: %s -- got: %s", ssh.KeyAlgoRSA, got)
+	}
+}
+
+func TestLocalBanner(t *testing.T) {
+	banner := "Authorized use only. Activity may be monitored.\n"
+	options := testOptions(t)
+	options.Banner = banner
+	host := testServer(t, options)
+
+	var got string
+	s, err := DialWithBanner(host, testUsername, 1, func(msg string) error {
+		got = msg
+		return nil
+	}, ssh.Password(testPassword))
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	s.Close()
+	if got != banner {
+		t.Errorf("banner want: %q -- got: %q", banner, got)
+	}
+
+	errRefused := errors.New("not agreeing to that")
+	_, err = DialWithBanner(host, testUsername, 1, func(_ string) error {
+		return errRefused
+	}, ssh.Password(testPassword))
+	if !errors.Is(err, errRefused) {
+		t.Errorf("want: %v -- got: %v", errRefused, err)
+	}
+}
+
+// scpRefuser takes what scp is sent, then fails with msg on stderr
+type scpRefuser struct {
+	ch  ssh.Channel
+	msg string
+}
+
+func (h *scpRefuser) SetChannel(ch ssh.Channel) {
+	h.ch = ch
+}
+
+func (h *scpRefuser) Exec(_ string) (int, error) {
+	io.Copy(ioutil.Discard, h.ch)
+	fmt.Fprintln(h.ch.Stderr(), h.msg)
+	return 1, nil
+}
+
+// TestLocalCopyConcurrent is best run with -race, as copies
+// share the connection's record of the most recent one
+func TestLocalCopyConcurrent(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &scpSink{}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	s.NoSFTPFallback = true
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- s.Copy(strings.NewReader("payload"), fmt.Sprintf("app%d.conf", i), "/etc", 7, 0644)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error("copy error:", err)
+		}
+	}
+	if s.Skipped() || s.LastTransport() != TransportSCP {
+		t.Errorf("want: %s, not skipped -- got: %s, skipped: %t", TransportSCP, s.LastTransport(), s.Skipped())
+	}
+}
+
+func TestLocalCopyStderr(t *testing.T) {
+	hndlr := &scpRefuser{msg: "scp: /etc/app.conf: Permission denied"}
+	options := testOptions(t)
+	options.Exec = hndlr
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	s.NoSFTPFallback = true
+
+	err = s.Copy(strings.NewReader("payload"), "app.conf", "/etc", 7, 0644)
+	var cerr CmdError
+	if !errors.As(err, &cerr) || cerr.RC != 1 {
+		t.Fatalf("want CmdError rc 1 -- got: %v", err)
+	}
+	if !strings.Contains(cerr.Stderr, hndlr.msg) {
+		t.Errorf("stderr want: %q -- got: %q", hndlr.msg, cerr.Stderr)
+	}
+	if errors.Is(err, ErrRemoteDirMissing) {
+		t.Errorf("permission denied taken for a missing dir: %v", err)
+	}
+
+	// a missing directory reported on stderr rather than as an scp status
+	hndlr.msg = "scp: /opt/app/app.conf: No such file or directory"
+	err = s.Copy(strings.NewReader("payload"), "app.conf", "/opt/app", 7, 0644)
+	if !errors.Is(err, ErrRemoteDirMissing) {
+		t.Fatalf("want: %v -- got: %v", ErrRemoteDirMissing, err)
+	}
+	if !errors.As(err, &cerr) || !strings.Contains(cerr.Stderr, hndlr.msg) || cerr.SCPLevel != 0 {
+		t.Errorf("want CmdError with stderr %q and no scp status -- got: %#v", hndlr.msg, err)
+	}
+}
+
+func TestLocalCopyFileMkdir(t *testing.T) {
+	sink := &scpSink{dirs: map[string]bool{}}
+	options := testOptions(t)
+	options.Exec = sink
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	filename := filepath.Join(t.TempDir(), "app.tar")
+	if err := ioutil.WriteFile(filename, []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = s.CopyFile(filename, "/opt/app")
+	if !errors.Is(err, ErrRemoteDirMissing) {
+		t.Fatalf("want: %v -- got: %v", ErrRemoteDirMissing, err)
+	}
+	var cerr CmdError
+	if !errors.As(err, &cerr) || cerr.RC != 1 || cerr.SCPLevel != SCPWarning {
+		t.Errorf("want CmdError with rc 1 and an scp warning -- got: %#v", err)
+	}
+	if want := "scp: /opt/app/app.tar: No such file or directory"; cerr.SCPMessage != want {
+		t.Errorf("message want: %q -- got: %q", want, cerr.SCPMessage)
+	}
+
+	if err := s.CopyFileMkdir(filename, "/opt/app"); err != nil {
+		t.Fatal("copy error:", err)
+	}
+	if sink.target != "/opt/app" || string(sink.data) != "payload" {
+		t.Errorf("want: /opt/app payload -- got: %s %s", sink.target, sink.data)
+	}
+}
+
+// signalHandler runs until it's sent a signal, reporting which
+type signalHandler struct {
+	ch      ssh.Channel
+	started chan struct{}
+	sigs    chan ssh.Signal
+}
+
+func (h *signalHandler) SetChannel(ch ssh.Channel) {
+	h.ch = ch
+}
+
+func (h *signalHandler) Exec(_ string) (int, error) {
+	close(h.started)
+	sig := <-h.sigs
+	fmt.Fprintf(h.ch, "got %s", sig)
+	return 130, nil
+}
+
+func (h *signalHandler) Signal(sig ssh.Signal) {
+	h.sigs <- sig
+}
+
+func TestLocalSignal(t *testing.T) {
+	hndlr := &signalHandler{started: make(chan struct{}), sigs: make(chan ssh.Signal, 1)}
+	options := testOptions(t)
+	options.Exec = hndlr
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	s.Buffered()
+
+	type result struct {
+		r   Results
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		r, err := Run(s, "tail -f /var/log/syslog")
+		done <- result{r, err}
+	}()
+	<-hndlr.started
+	if err := s.Signal(ssh.SIGINT); err != nil {
+		t.Fatal("signal error:", err)
+	}
+	res := <-done
+	if res.r.RC != 130 || res.r.Stdout != "got INT" {
+		t.Errorf("want: 130 %q -- got: %d %q (%v)", "got INT", res.r.RC, res.r.Stdout, res.err)
+	}
+}
+
+func TestLocalStartWait(t *testing.T) {
+	hndlr := &signalHandler{started: make(chan struct{}), sigs: make(chan ssh.Signal, 1)}
+	options := testOptions(t)
+	options.Exec = hndlr
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	s.Buffered()
+
+	if err := s.Start("tail -f /var/log/syslog"); err != nil {
+		t.Fatal("start error:", err)
+	}
+	<-hndlr.started
+	if err := s.Signal(ssh.SIGHUP); err != nil {
+		t.Fatal("signal error:", err)
+	}
+	r, err := s.Wait()
+	if r.RC != 130 || r.Stdout != "got HUP" {
+		t.Errorf("want: 130 %q -- got: %d %q (%v)", "got HUP", r.RC, r.Stdout, err)
+	}
+}
+
+func TestLocalDial(t *testing.T) {
+	options := testOptions(t)
+	options.Banner = "welcome\n"
+	host := testServer(t, options)
+
+	var banner string
+	var checked bool
+	env := map[string]string{"LANG": "C"}
+	s, err := Dial(host, testUsername, DialOptions{
+		Timeout: time.Second,
+		Auth:    []ssh.AuthMethod{ssh.Password(testPassword)},
+		HostKeyCallback: func(_ string, _ net.Addr, _ ssh.PublicKey) error {
+			checked = true
+			return nil
+		},
+		BannerCallback: func(msg string) error {
+			banner = msg
+			return nil
+		},
+		Ciphers:   []string{"aes128-ctr"},
+		LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		Env:       env,
+	})
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	if !checked {
+		t.Error("host key callback not called")
+	}
+	if banner != options.Banner {
+		t.Errorf("banner want: %q -- got: %q", options.Banner, banner)
+	}
+	if s.Environment["LANG"] != "C" {
+		t.Errorf("environment not set: %v", s.Environment)
+	}
+
+	if _, err := Dial(host, testUsername, DialOptions{Timeout: time.Second}); !errors.Is(err, ErrNoAuthMethods) {
+		t.Errorf("want: %v -- got: %v", ErrNoAuthMethods, err)
+	}
+}
+
+// directTCPIP serves "direct-tcpip" channels by connecting to the
+// address the client asks for, as sshd does for `ssh -L`
+func directTCPIP(newChannel ssh.NewChannel) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	addr := net.JoinHostPort(target.Host, fmt.Sprint(target.Port))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+	io.Copy(conn, ch)
+	conn.Close()
+	ch.Close()
+}
+
+func TestLocalForwardLocal(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			fmt.Fprint(conn, "hello from there")
+			conn.Close()
+		}
+	}()
+
+	options := testOptions(t)
+	options.ChannelHandlers = map[string]func(ssh.NewChannel){"direct-tcpip": directTCPIP}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	fwd, err := s.ForwardLocal("127.0.0.1:0", l.Addr().String())
+	if err != nil {
+		t.Fatal("forward error:", err)
+	}
+	defer fwd.Close()
+	conn, err := net.Dial("tcp", fwd.Addr().String())
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer conn.Close()
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if string(b) != "hello from there" {
+		t.Errorf("want: %q -- got: %q", "hello from there", b)
+	}
+}
+
+func TestLocalJump(t *testing.T) {
+	options := testOptions(t)
+	options.ChannelHandlers = map[string]func(ssh.NewChannel){"direct-tcpip": directTCPIP}
+	host := testServer(t, options)
+
+	bastion, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer bastion.Close()
+
+	config := dialConfig(testUsername, 1, []ssh.AuthMethod{ssh.Password(testPassword)})
+	s, err := DialJump(bastion, host, testUsername, config)
+	if err != nil {
+		t.Fatal("jump error:", err)
+	}
+	defer s.Close()
+	r, err := s.Exec("echo hop")
+	if err != nil {
+		t.Fatal("exec error:", err)
+	}
+	if want := `command is: "echo hop"`; r.Stdout != want {
+		t.Errorf("want: %q -- got: %q", want, r.Stdout)
+	}
+}
+
+func TestLocalChannelRejected(t *testing.T) {
+	host := testServer(t, nil)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	if _, err := s.Client().Dial("tcp", "127.0.0.1:22"); err == nil {
+		t.Error("forwarding channel accepted without a handler")
+	}
+}
+
+// envHandler reports the environment it's given for each command
+type envHandler struct {
+	ch  ssh.Channel
+	env map[string]string
+}
+
+func (h *envHandler) SetChannel(ch ssh.Channel) {
+	h.ch = ch
+}
+
+func (h *envHandler) SetEnv(env map[string]string) {
+	h.env = env
+}
+
+func (h *envHandler) Exec(_ string) (int, error) {
+	for _, key := range envKeys(h.env) {
+		fmt.Fprintf(h.ch, "%s=%s\n", key, h.env[key])
+	}
+	return 0, nil
+}
+
+func TestLocalEnv(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &envHandler{}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+	s.Buffered()
+
+	s.Environment = map[string]string{"LANG": "C", "TZ": "UTC"}
+	r, err := Run(s, "env")
+	if err != nil {
+		t.Fatal("run error:", err)
+	}
+	if want := "LANG=C\nTZ=UTC\n"; r.Stdout != want {
+		t.Errorf("want: %q -- got: %q", want, r.Stdout)
+	}
+
+	// as does a session of Exec's own
+	r, err = s.Exec("env")
+	if err != nil {
+		t.Fatal("exec error:", err)
+	}
+	if want := "LANG=C\nTZ=UTC\n"; r.Stdout != want {
+		t.Errorf("want: %q -- got: %q", want, r.Stdout)
+	}
+
+	// a fresh session starts without them
+	r, err = s.RunEnv("env", map[string]string{"DEBUG": "1"})
+	if err != nil {
+		t.Fatal("run error:", err)
+	}
+	if want := "DEBUG=1\n"; r.Stdout != want {
+		t.Errorf("want: %q -- got: %q", want, r.Stdout)
+	}
+
+	out, _, err := RunCombined(s, "env")
+	if err != nil {
+		t.Fatal("combined error:", err)
+	}
+	if want := "LANG=C\nTZ=UTC\n"; out != want {
+		t.Errorf("combined want: %q -- got: %q", want, out)
+	}
+
+	// as does RunFiles, in a connection's session of its own
+	f, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer f.Close()
+	f.Environment = s.Environment
+	outFile := filepath.Join(t.TempDir(), "stdout")
+	if _, err := f.RunFiles("env", "", outFile, ""); err != nil {
+		t.Fatal("run files error:", err)
+	}
+	if b, _ := ioutil.ReadFile(outFile); string(b) != "LANG=C\nTZ=UTC\n" {
+		t.Errorf("want: %q -- got: %q", "LANG=C\nTZ=UTC\n", b)
+	}
+}
+
+func TestLocalTrustedCA(t *testing.T) {
+	ca := testCA(t)
+	options := testOptions(t)
+	options.TrustedCA = ssh.MarshalAuthorizedKey(ca.PublicKey())
+	host := testServer(t, options)
+
+	certFile, keyFile := testCert(t, ca, testUsername)
+	s, err := DialCert(host, testUsername, certFile, keyFile, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	s.Close()
+
+	for name, ca := range map[string]ssh.Signer{"principal": ca, "ca": testCA(t)} {
+		principal := testUsername
+		if name == "principal" {
+			principal = "root"
+		}
+		certFile, keyFile := testCert(t, ca, principal)
+		if _, err := DialCert(host, testUsername, certFile, keyFile, 1); !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("wrong %s want: %v -- got: %v", name, ErrAuthFailed, err)
+		}
+	}
+}
+
+func TestCheckUserCert(t *testing.T) {
+	ca, other := testCA(t), testCA(t)
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+	}
+	sign := func(signer ssh.Signer, validBefore uint64) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:             signer.PublicKey(),
+			CertType:        ssh.UserCert,
+			ValidPrincipals: []string{"deploy"},
+			ValidBefore:     validBefore,
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	tests := []struct {
+		name string
+		user string
+		cert *ssh.Certificate
+		want error
+	}{
+		{"valid", "deploy", sign(ca, ssh.CertTimeInfinity), nil},
+		{"untrusted", "deploy", sign(other, ssh.CertTimeInfinity), ErrCertUntrusted},
+		{"expired", "deploy", sign(ca, uint64(time.Now().Add(-time.Hour).Unix())), ErrCertExpired},
+		{"principal", "root", sign(ca, ssh.CertTimeInfinity), ErrCertPrincipal},
+	}
+	for _, tt := range tests {
+		err := checkUserCert(checker, tt.user, tt.cert)
+		if tt.want == nil && err != nil || !errors.Is(err, tt.want) {
+			t.Errorf("%s want: %v -- got: %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestLocalHostCert(t *testing.T) {
+	ca := testCA(t)
+	options := testOptions(t)
+	options.KeyFile = ""
+	options.HostKeys = testHostKeys(t)
+	hostKey, err := ssh.ParsePrivateKey(options.HostKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             hostKey.PublicKey(),
+		CertType:        ssh.HostCert,
+		KeyId:           "test host",
+		ValidPrincipals: []string{"localhost", "127.0.0.1"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	options.HostCerts = [][]byte{ssh.MarshalAuthorizedKey(cert)}
+	host := testServer(t, options)
+
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+			return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+	}
+	config := dialConfig(testUsername, 1, []ssh.AuthMethod{ssh.Password(testPassword)})
+	config.HostKeyCallback = checker.CheckHostKey
+	s, err := DialConfigSSH(host, testUsername, config, PreferHostKeyAlgos(ssh.CertAlgoED25519v01))
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	s.Close()
+
+	// the bare key is still offered to clients that don't want the cert
+	config.HostKeyCallback = ssh.FixedHostKey(hostKey.PublicKey())
+	s, err = DialConfigSSH(host, testUsername, config, PreferHostKeyAlgos(ssh.KeyAlgoED25519))
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	s.Close()
+}
+
+func TestLocalRunJSON(t *testing.T) {
+	hndlr := &MockHandler{Stdout: `[{"Id":"3f4e","State":{"Running":true}}]`}
+	options := testOptions(t)
+	options.Exec = hndlr
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	type container struct {
+		ID    string `json:"Id"`
+		State struct{ Running bool }
+	}
+	got, err := RunJSON[[]container](s, "docker inspect web")
+	if err != nil {
+		t.Fatal("run error:", err)
+	}
+	if len(got) != 1 || got[0].ID != "3f4e" || !got[0].State.Running {
+		t.Errorf("unexpected result: %+v", got)
+	}
+
+	hndlr.Stdout = "not json"
+	if _, err := RunJSON[[]container](s, "docker inspect web"); err == nil {
+		t.Error("no error decoding bad output")
+	}
+
+	hndlr.RC, hndlr.Stdout, hndlr.Stderr = 1, "[]", "Error: No such object: web"
+	_, err = RunJSON[[]container](s, "docker inspect web")
+	var cerr CmdError
+	if !errors.As(err, &cerr) || cerr.RC != 1 || cerr.Stderr != hndlr.Stderr {
+		t.Errorf("want CmdError rc 1 -- got: %v", err)
+	}
+}
+
+// stallHandler takes commands but never finishes them, until released
+type stallHandler struct {
+	ch      ssh.Channel
+	release chan struct{}
+}
+
+func (h *stallHandler) SetChannel(ch ssh.Channel) {
+	h.ch = ch
+}
+
+func (h *stallHandler) Exec(cmd string) (int, error) {
+	if !strings.Contains(cmd, "scp -tq ") {
+		return 0, nil
+	}
+	<-h.release
+	return 0, nil
+}
+
+func TestLocalCopyTimeout(t *testing.T) {
+	hndlr := &stallHandler{release: make(chan struct{})}
+	defer close(hndlr.release)
+	options := testOptions(t)
+	options.Exec = hndlr
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	s.CopyTimeout = 100 * time.Millisecond
+	start := time.Now()
+	err = s.Copy(strings.NewReader("payload"), "app.conf", "/etc", 7, 0644)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("want: %v -- got: %v", ErrTimeout, err)
+	}
+	var cerr CmdError
+	if errors.As(err, &cerr) {
+		t.Errorf("timeout reported as a command failure: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("copy took %v to time out", elapsed)
+	}
+}
+
+func TestLocalCopyContext(t *testing.T) {
+	hndlr := &stallHandler{release: make(chan struct{})}
+	defer close(hndlr.release)
+	options := testOptions(t)
+	options.Exec = hndlr
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	err = s.CopyContext(ctx, strings.NewReader("payload"), "app.conf", "/etc", 7, 0644)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want: %v -- got: %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("copy took %v to cancel", elapsed)
+	}
+
+	// nothing is sent once ctx is done
+	err = s.CopyContext(ctx, strings.NewReader("payload"), "app.conf", "/etc", 7, 0644)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled want: %v -- got: %v", context.Canceled, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = s.CopyContext(ctx, strings.NewReader("payload"), "app.conf", "/etc", 7, 0644)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("deadline want: %v -- got: %v", ErrTimeout, err)
+	}
+}
+
+func TestLocalExecMany(t *testing.T) {
+	var mu sync.Mutex
+	var running, most, runs int
+	busy := StreamFunc(func(cmd string, w io.Writer) (int, error) {
+		mu.Lock()
+		runs++
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		fmt.Fprint(w, cmd)
+		return 0, nil
+	})
+	var hosts []string
+	for i := 0; i < 4; i++ {
+		options := testOptions(t)
+		options.Exec = busy
+		hosts = append(hosts, testServer(t, options))
+	}
+	// nothing listens on the tcpmux port
+	hosts = append(hosts, "localhost:1")
+
+	opts := DialOptions{Timeout: time.Second, Auth: []ssh.AuthMethod{ssh.Password(testPassword)}}
+	results := ExecMany(hosts, testUsername, "uptime", opts, 2)
+	if len(results) != len(hosts) {
+		t.Fatalf("want %d results -- got: %d", len(hosts), len(results))
+	}
+	for _, host := range hosts[:4] {
+		r := results[host]
+		if r.Err != nil || r.Results.Stdout != "uptime" {
+			t.Errorf("%s: want: %q -- got: %+v", host, "uptime", r)
+		}
+	}
+	if err := results["localhost:1"].Err; !errors.Is(err, ErrHostUnreachable) {
+		t.Errorf("want: %v -- got: %v", ErrHostUnreachable, err)
+	}
+	if most > 2 {
+		t.Errorf("ran on %d hosts at once, limit was 2", most)
+	}
+
+	// a host listed twice is run on once
+	mu.Lock()
+	runs = 0
+	mu.Unlock()
+	results = ExecMany([]string{hosts[0], hosts[0]}, testUsername, "uptime", opts, 0)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(results) != 1 || runs != 1 {
+		t.Errorf("repeated host want 1 result from 1 run -- got: %d from %d", len(results), runs)
+	}
+}
+
+func TestLocalExecManyEnv(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &envHandler{}
+	host := testServer(t, options)
+
+	opts := DialOptions{
+		Timeout: time.Second,
+		Auth:    []ssh.AuthMethod{ssh.Password(testPassword)},
+		Env:     map[string]string{"LANG": "C"},
+	}
+	r := ExecMany([]string{host}, testUsername, "env", opts, 1)[host]
+	if r.Err != nil {
+		t.Fatal("exec error:", r.Err)
+	}
+	if want := "LANG=C\n"; r.Results.Stdout != want {
+		t.Errorf("want: %q -- got: %q", want, r.Results.Stdout)
+	}
+}
+
+func TestLocalIdleTimeout(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = StreamFunc(func(cmd string, w io.Writer) (int, error) {
+		if cmd == "slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		fmt.Fprint(w, cmd)
+		return 0, nil
+	})
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	s.SetIdleTimeout(50 * time.Millisecond)
+	// a command outlasting the timeout keeps the connection in use
+	if _, err := s.Exec("slow"); err != nil {
+		t.Fatal("closed while in use:", err)
+	}
+	for i := 0; i < 3; i++ {
+		time.Sleep(25 * time.Millisecond)
+		if _, err := s.Exec("quick"); err != nil {
+			t.Fatal("closed while in use:", err)
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, err := s.Exec("quick"); !errors.Is(err, ErrIdleClosed) {
+		t.Errorf("want: %v -- got: %v", ErrIdleClosed, err)
+	}
+	if err := s.Copy(strings.NewReader("payload"), "app.conf", "/etc", 7, 0644); !errors.Is(err, ErrIdleClosed) {
+		t.Errorf("copy want: %v -- got: %v", ErrIdleClosed, err)
+	}
+
+	// closing stops the timer
+	s, err = DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	s.SetIdleTimeout(time.Hour)
+	s.Close()
+	if s.idleTimer != nil {
+		t.Error("idle timer still running after Close")
+	}
+}
+
+// sftpHandler serves sftp on its channel, once delay has passed
+type sftpHandler struct {
+	ch    ssh.Channel
+	delay time.Duration
+}
+
+func (h *sftpHandler) SetChannel(ch ssh.Channel) {
+	h.ch = ch
+}
+
+func (h *sftpHandler) Exec(_ string) (int, error) {
+	time.Sleep(h.delay)
+	server, err := sftp.NewServer(h.ch)
+	if err != nil {
+		return 1, err
+	}
+	if err := server.Serve(); err != nil && err != io.EOF {
+		return 1, err
+	}
+	return 0, nil
+}
+
+// TestLocalIdleInUse checks that each way of using a connection keeps
+// the idle timeout from closing it while it's in use
+func TestLocalIdleInUse(t *testing.T) {
+	const (
+		idle = 50 * time.Millisecond
+		slow = 200 * time.Millisecond
+	)
+	options := testOptions(t)
+	options.Exec = StreamFunc(func(cmd string, w io.Writer) (int, error) {
+		time.Sleep(slow)
+		fmt.Fprint(w, cmd)
+		return 0, nil
+	})
+	options.Subsystems = map[string]ExecHandler{
+		"echo": &catHandler{},
+		"sftp": &sftpHandler{delay: slow},
+	}
+	options.ChannelHandlers = map[string]func(ssh.NewChannel){"direct-tcpip": directTCPIP}
+	host := testServer(t, options)
+
+	sudoOptions := testOptions(t)
+	sudoOptions.Exec = &sudoHandler{delay: slow}
+	sudoHost := testServer(t, sudoOptions)
+
+	bashOptions := testOptions(t)
+	bashOptions.Exec = &BashHandler{}
+	bashHost := testServer(t, bashOptions)
+
+	remote := filepath.Join(t.TempDir(), "remote")
+	if err := ioutil.WriteFile(remote, []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		host string
+		use  func(s *Connection) error
+	}{
+		{"start", host, func(s *Connection) error {
+			if err := s.Start("slow"); err != nil {
+				return err
+			}
+			// as when streaming its output meanwhile
+			time.Sleep(slow / 2)
+			_, err := s.Wait()
+			return err
+		}},
+		{"pipe", host, func(s *Connection) error {
+			return PipeToRemote(exec.Command("true"), s, "slow")
+		}},
+		{"sudo", sudoHost, func(s *Connection) error {
+			_, err := RunSudo(s, "whoami", "")
+			return err
+		}},
+		{"shell", bashHost, func(s *Connection) error {
+			_, err := RunInShell(s, "sleep 0.2")
+			return err
+		}},
+		{"subsystem", host, func(s *Connection) error {
+			stream, err := s.Subsystem("echo")
+			if err != nil {
+				return err
+			}
+			defer stream.Close()
+			time.Sleep(slow)
+			fmt.Fprint(stream, "ping")
+			stream.CloseWrite()
+			if b, err := ioutil.ReadAll(stream); err != nil || string(b) != "ping" {
+				return fmt.Errorf("want: %q -- got: %q (%v)", "ping", b, err)
+			}
+			_, err = stream.Wait()
+			return err
+		}},
+		{"subsystem session", host, func(s *Connection) error {
+			session, err := s.SubsystemSession("echo")
+			if err != nil {
+				return err
+			}
+			defer session.Close()
+			w, err := session.StdinPipe()
+			if err != nil {
+				return err
+			}
+			r, err := session.StdoutPipe()
+			if err != nil {
+				return err
+			}
+			time.Sleep(slow)
+			fmt.Fprint(w, "ping")
+			w.Close()
+			if b, err := ioutil.ReadAll(r); err != nil || string(b) != "ping" {
+				return fmt.Errorf("want: %q -- got: %q (%v)", "ping", b, err)
+			}
+			return nil
+		}},
+		{"sftp", host, func(s *Connection) error {
+			client, err := s.SFTP()
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+			time.Sleep(slow)
+			_, err = client.Stat(remote)
+			return err
+		}},
+		{"parallel", host, func(s *Connection) error {
+			return s.GetFileParallel(remote, filepath.Join(t.TempDir(), "local"), 2)
+		}},
+		{"forward", host, func(s *Connection) error {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return err
+			}
+			defer l.Close()
+			go func() {
+				if conn, err := l.Accept(); err == nil {
+					fmt.Fprint(conn, "hello")
+					conn.Close()
+				}
+			}()
+			fwd, err := s.ForwardLocal("127.0.0.1:0", l.Addr().String())
+			if err != nil {
+				return err
+			}
+			defer fwd.Close()
+			time.Sleep(slow)
+			conn, err := net.Dial("tcp", fwd.Addr().String())
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			if b, err := ioutil.ReadAll(conn); err != nil || string(b) != "hello" {
+				return fmt.Errorf("want: %q -- got: %q (%v)", "hello", b, err)
+			}
+			return nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := DialPassword(tt.host, testUsername, testPassword, 1)
+			if err != nil {
+				t.Fatal("ssh connect error:", err)
+			}
+			defer s.Close()
+			s.SetIdleTimeout(idle)
+			if err := tt.use(s); err != nil {
+				t.Fatal("closed while in use:", err)
+			}
+
+			// once done with, the connection goes idle as before
+			time.Sleep(3 * idle)
+			if _, err := s.Exec("quick"); !errors.Is(err, ErrIdleClosed) {
+				t.Errorf("want: %v -- got: %v", ErrIdleClosed, err)
+			}
+		})
+	}
+}
+
+func TestLocalPool(t *testing.T) {
+	host := testServer(t, nil)
+	opts := DialOptions{Timeout: time.Second, Auth: []ssh.AuthMethod{ssh.Password(testPassword)}}
+
+	pool := NewPool(0)
+	a, err := pool.Get(host, testUsername, opts)
+	if err != nil {
+		t.Fatal("pool error:", err)
+	}
+	b, err := pool.Get(host, testUsername, opts)
+	if err != nil {
+		t.Fatal("pool error:", err)
+	}
+	if a != b {
+		t.Error("connection not reused")
+	}
+
+	// a dead connection is replaced
+	a.Client().Close()
+	c, err := pool.Get(host, testUsername, opts)
+	if err != nil {
+		t.Fatal("pool error:", err)
+	}
+	if c == a {
+		t.Error("dead connection reused")
+	}
+	if _, err := c.Exec("uptime"); err != nil {
+		t.Error("exec error:", err)
+	}
+
+	pool.Close()
+	if _, err := c.Exec("uptime"); err == nil {
+		t.Error("connection still open after pool closed")
+	}
+	if _, err := pool.Get(host, testUsername, opts); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("want: %v -- got: %v", ErrPoolClosed, err)
+	}
+}
+
+func TestLocalPoolIdle(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = StreamFunc(func(cmd string, w io.Writer) (int, error) {
+		if cmd == "slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		fmt.Fprint(w, cmd)
+		return 0, nil
+	})
+	host := testServer(t, options)
+	opts := DialOptions{Timeout: time.Second, Auth: []ssh.AuthMethod{ssh.Password(testPassword)}}
+
+	pool := NewPool(50 * time.Millisecond)
+	defer pool.Close()
+	conn, err := pool.Get(host, testUsername, opts)
+	if err != nil {
+		t.Fatal("pool error:", err)
+	}
+	if n := pool.Len(); n != 1 {
+		t.Fatalf("want 1 pooled -- got: %d", n)
+	}
+	// a connection in use outlasting the timeout is kept
+	if _, err := conn.Exec("slow"); err != nil {
+		t.Fatal("evicted while in use:", err)
+	}
+	if n := pool.Len(); n != 1 {
+		t.Fatalf("in use connection evicted, %d pooled", n)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := pool.Len(); n != 0 {
+		t.Errorf("idle connection not evicted, %d pooled", n)
+	}
+}
+
+func TestLocalDialTimed(t *testing.T) {
+	options := testOptions(t)
+	options.AuthDelay = 50 * time.Millisecond
+	host := testServer(t, options)
+
+	opts := DialOptions{Timeout: time.Second, Auth: []ssh.AuthMethod{ssh.Password(testPassword)}}
+	s, timings, err := DialTimed(host, testUsername, opts)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	s.Close()
+	if timings.Handshake < options.AuthDelay {
+		t.Errorf("handshake took %v, less than the auth delay", timings.Handshake)
+	}
+	if timings.TCPConnect <= 0 || timings.Total < timings.TCPConnect+timings.Handshake {
+		t.Errorf("inconsistent timings: %+v", timings)
+	}
+
+	// nothing listens on port 1
+	_, timings, err = DialTimed("127.0.0.1:1", testUsername, opts)
+	if err == nil {
+		t.Fatal("dialed a closed port")
+	}
+	if timings.TCPConnect <= 0 || timings.Handshake != 0 {
+		t.Errorf("failed connect timings: %+v", timings)
+	}
+}
+
+func TestLocalCloseTwice(t *testing.T) {
+	host := testServer(t, nil)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Error("close error:", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Error("second close error:", err)
+	}
+	if _, err := s.Exec("uptime"); err == nil {
+		t.Error("exec succeeded after close")
+	}
+}
+
+func TestLocalCloseAfterRun(t *testing.T) {
+	host := testServer(t, nil)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	if _, err := Run(s, "uptime"); err != nil {
+		t.Fatal("run error:", err)
+	}
+	// the session is done with, which isn't an error
+	if err := s.Close(); err != nil {
+		t.Error("close error:", err)
+	}
+}
+
+func TestLocalStdoutPipe(t *testing.T) {
+	dump := strings.Repeat("INSERT INTO t VALUES (1);\n", 1<<12)
+	options := testOptions(t)
+	options.Exec = &MockHandler{Stdout: dump, Stderr: "dump complete"}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal("pipe error:", err)
+	}
+	stderr, err := s.StderrPipe()
+	if err != nil {
+		t.Fatal("pipe error:", err)
+	}
+	if err := s.Start("mysqldump app"); err != nil {
+		t.Fatal("start error:", err)
+	}
+	var errOut []byte
+	errDone := make(chan struct{})
+	go func() {
+		errOut, _ = ioutil.ReadAll(stderr)
+		close(errDone)
+	}()
+	out, err := ioutil.ReadAll(stdout)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	<-errDone
+	if _, err := s.Wait(); err != nil {
+		t.Fatal("wait error:", err)
+	}
+	if string(out) != dump || string(errOut) != "dump complete" {
+		t.Errorf("read %d bytes of stdout, stderr %q", len(out), errOut)
+	}
+
+	if _, err := s.StdoutPipe(); err == nil {
+		t.Error("second stdout pipe allowed")
+	}
+}
+
+func TestLocalSigner(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := testOptions(t)
+	options.AuthorizedKeys = [][]byte{ssh.MarshalAuthorizedKey(signer.PublicKey())}
+	host := testServer(t, options)
+
+	s, err := DialSigner(host, testUsername, 1, signer)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	s.Close()
+
+	if _, err := DialSigner(host, testUsername, 1); !errors.Is(err, ErrNoAuthMethods) {
+		t.Errorf("want: %v -- got: %v", ErrNoAuthMethods, err)
+	}
+}
+
+func TestLocalMaxAuthTries(t *testing.T) {
+	options := testOptions(t)
+	options.MaxAuthTries = 2
+	options.FailureDelay = 20 * time.Millisecond
+	host := testServer(t, options)
+
+	var attempts int
+	wrong := ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+		attempts++
+		return "wrong", nil
+	}), 10)
+	start := time.Now()
+	_, err := DialSSH(host, testUsername, 1, wrong)
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("want: %v -- got: %v", ErrAuthFailed, err)
+	}
+	if attempts > options.MaxAuthTries+1 {
+		t.Errorf("server allowed %d attempts, more than %d", attempts, options.MaxAuthTries)
+	}
+	if elapsed := time.Since(start); elapsed < time.Duration(options.MaxAuthTries)*options.FailureDelay {
+		t.Errorf("failures weren't delayed, took %v", elapsed)
+	}
+
+	// a right password still gets in
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	s.Close()
+}
+
+func TestLocalUploadDownload(t *testing.T) {
+	sink := &scpSink{}
+	options := testOptions(t)
+	options.Exec = sink
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	// the test server has no sftp, so both fall back to scp
+	dir := t.TempDir()
+	local := filepath.Join(dir, "deploy.sh")
+	content := []byte("#!/bin/sh\necho deployed\n")
+	if err := ioutil.WriteFile(local, content, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Upload(local, "/usr/local/bin/deploy.sh"); err != nil {
+		t.Fatal("upload error:", err)
+	}
+	if s.LastTransport() != TransportSCP {
+		t.Errorf("want: %s -- got: %s", TransportSCP, s.LastTransport())
+	}
+	if sink.name != "deploy.sh" || sink.mode != 0755 || string(sink.data) != string(content) {
+		t.Errorf("received %s %#o %q", sink.name, sink.mode, sink.data)
+	}
+
+	back := filepath.Join(dir, "fetched.sh")
+	if err := s.Download("/usr/local/bin/deploy.sh", back); err != nil {
+		t.Fatal("download error:", err)
+	}
+	got, err := ioutil.ReadFile(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(content) {
+		t.Errorf("want: %q -- got: %q", content, got)
+	}
+	if info, err := os.Stat(back); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("mode want: %#o -- got: %v (%v)", 0755, info.Mode(), err)
+	}
+}
+
+func TestLocalInteractive(t *testing.T) {
+	options := testOptions(t)
+	options.Exec = &BashHandler{}
+	host := testServer(t, options)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	if err := s.Interactive("vt100", 80, 24); err == nil {
+		t.Fatal("interactive without a terminal")
+	}
+
+	// stand in for the user at a terminal
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	stdin, stdout, stderr := os.Stdin, os.Stdout, os.Stderr
+	os.Stdin, os.Stdout, os.Stderr = tty, tty, tty
+	defer func() {
+		os.Stdin, os.Stdout, os.Stderr = stdin, stdout, stderr
+	}()
+	before, err := term.GetState(int(tty.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	go io.Copy(&out, ptmx)
+	fmt.Fprint(ptmx, "echo term=$TERM; exit 3\n")
+	err = s.Interactive("vt100", 80, 24)
+	if r := newResults(err, "", ""); r.RC != 3 {
+		t.Errorf("rc want: 3 -- got: %d (%v)", r.RC, err)
+	}
+	after, err := term.GetState(int(tty.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(before, after) {
+		t.Error("terminal not restored")
+	}
+	time.Sleep(50 * time.Millisecond)
+	ptmx.Close()
+	if !strings.Contains(out.String(), "term=vt100") {
+		t.Errorf("TERM not set, output: %q", out.String())
 	}
 }
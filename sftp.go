@@ -0,0 +1,219 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	// maxParallelChunks bounds the number of concurrent reads in GetFileParallel
+	maxParallelChunks = 16
+
+	// minChunkSize is the smallest byte range worth fetching on its own
+	minChunkSize = 1 << 20
+)
+
+// Transport identifies the protocol used to transfer a file
+type Transport string
+
+// Supported file transfer protocols
+const (
+	TransportSCP  Transport = "scp"
+	TransportSFTP Transport = "sftp"
+)
+
+// SFTPClient is an sftp session on a Connection, for file transfers that
+// don't depend on the remote host having scp. The embedded sftp.Client
+// offers the full range of sftp operations
+type SFTPClient struct {
+	*sftp.Client
+	done func()
+}
+
+// SFTP starts an sftp session on the connection, which must be closed when done.
+// The connection counts as in use until then
+func (s *Connection) SFTP() (*SFTPClient, error) {
+	done, err := s.busy()
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(s.client)
+	if err != nil {
+		done()
+		return nil, fmt.Errorf("can't start sftp -- %w", err)
+	}
+	return &SFTPClient{Client: client, done: done}, nil
+}
+
+// Close ends the sftp session, leaving the connection open
+func (c *SFTPClient) Close() error {
+	defer c.done()
+	return c.Client.Close()
+}
+
+// Upload writes the reader contents to remotePath, creating or truncating it
+func (c *SFTPClient) Upload(r io.Reader, remotePath string, mode os.FileMode) error {
+	f, err := c.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("can't create %q -- %w", remotePath, err)
+	}
+	if n, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("copy %d with error: %w", n, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return c.Chmod(remotePath, mode.Perm())
+}
+
+// Download writes the contents of remotePath to w
+func (c *SFTPClient) Download(remotePath string, w io.Writer) error {
+	f, err := c.Open(remotePath)
+	if err != nil {
+		return fmt.Errorf("can't open %q -- %w", remotePath, err)
+	}
+	defer f.Close()
+	if n, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("copy %d with error: %w", n, err)
+	}
+	return nil
+}
+
+// sftpCopy writes the reader contents to filename on the remote host via sftp,
+// following scp's rules: if dest is a directory the file is created in it,
+// otherwise dest is the file to write. The sftp session is closed to
+// abort the transfer if ctx is done first
+func (s *Connection) sftpCopy(ctx context.Context, r io.Reader, filename, dest string, mode os.FileMode) error {
+	client, err := s.SFTP()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	defer closeOnDone(ctx, client)()
+
+	target := dest
+	if info, err := client.Stat(dest); err == nil && info.IsDir() {
+		target = path.Join(dest, filename)
+	}
+	return client.Upload(r, target, mode)
+}
+
+// sectionWriter writes sequentially to w, starting at off
+type sectionWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (sw *sectionWriter) Write(b []byte) (int, error) {
+	n, err := sw.w.WriteAt(b, sw.off)
+	sw.off += int64(n)
+	return n, err
+}
+
+// GetFileParallel downloads remotePath to localPath via sftp, fetching up to
+// chunks distinct byte ranges concurrently, each over its own file handle.
+// Small files, or servers that refuse additional handles, fall back to a
+// single stream.
+func (s *Connection) GetFileParallel(remotePath, localPath string, chunks int) error {
+	client, err := s.SFTP()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	info, err := client.Stat(remotePath)
+	if err != nil {
+		return fmt.Errorf("can't stat %q -- %w", remotePath, err)
+	}
+	size := info.Size()
+
+	f, err := os.OpenFile(localPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("can't create %q -- %w", localPath, err)
+	}
+	defer f.Close()
+
+	if chunks > maxParallelChunks {
+		chunks = maxParallelChunks
+	}
+	if n := int(size / minChunkSize); chunks > n {
+		chunks = n
+	}
+	if chunks < 1 {
+		chunks = 1
+	}
+
+	files, err := openHandles(client.Client, remotePath, chunks)
+	if err != nil {
+		return err
+	}
+	if err := getRanges(files, f, size); err != nil {
+		return fmt.Errorf("download of %q failed: %w", remotePath, err)
+	}
+
+	local, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if local.Size() != size {
+		return fmt.Errorf("size mismatch for %q -- want: %d got: %d", localPath, size, local.Size())
+	}
+	return f.Close()
+}
+
+// openHandles opens up to n handles to the remote file, settling for
+// however many the server will hand out (at least one)
+func openHandles(client *sftp.Client, remotePath string, n int) ([]*sftp.File, error) {
+	files := make([]*sftp.File, 0, n)
+	for i := 0; i < n; i++ {
+		rf, err := client.Open(remotePath)
+		if err != nil {
+			if i > 0 {
+				break
+			}
+			return nil, fmt.Errorf("can't open %q -- %w", remotePath, err)
+		}
+		files = append(files, rf)
+	}
+	return files, nil
+}
+
+// getRanges splits size bytes evenly across the given handles and copies
+// each range into w concurrently, closing the handles when done
+func getRanges(files []*sftp.File, w io.WriterAt, size int64) error {
+	chunk := size / int64(len(files))
+	errs := make(chan error, len(files))
+	for i, rf := range files {
+		off := int64(i) * chunk
+		n := chunk
+		if i == len(files)-1 {
+			n = size - off
+		}
+		go func(rf *sftp.File, off, n int64) {
+			defer rf.Close()
+			copied, err := io.Copy(&sectionWriter{w, off}, io.NewSectionReader(rf, off, n))
+			if err == nil && copied != n {
+				err = fmt.Errorf("range at %d: %w", off, io.ErrUnexpectedEOF)
+			}
+			errs <- err
+		}(rf, off, n)
+	}
+
+	var err error
+	for range files {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RunInShell runs cmd in a persistent shell on the session, started on
+// first use, so state such as the working directory carries over between
+// calls. The end of the command's output is found by having the shell print
+// a random marker and the exit code once the command completes.
+// Only stdout is captured; stderr goes wherever the session sends it
+func RunInShell(session *Connection, cmd string) (Results, error) {
+	done, err := session.busy()
+	if err != nil {
+		return Results{}, err
+	}
+	defer done()
+	if session.shellIn == nil {
+		w, err := session.ssh.StdinPipe()
+		if err != nil {
+			return Results{}, err
+		}
+		r, err := session.ssh.StdoutPipe()
+		if err != nil {
+			return Results{}, err
+		}
+		if err := session.applyEnv(); err != nil {
+			return Results{}, err
+		}
+		if err := session.ssh.Shell(); err != nil {
+			return Results{}, fmt.Errorf("can't start shell: %w", err)
+		}
+		session.shellIn = w
+		session.shellOut = bufio.NewReader(r)
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return Results{}, err
+	}
+	// the marker is printed in two halves, so that a terminal echoing
+	// the input back can't produce a line that matches it
+	head, tail := "__sshclient_"+hex.EncodeToString(b[:4]), hex.EncodeToString(b[4:])+"__"
+	fmt.Fprintf(session.shellIn, "%s\nprintf '\\n%%s%%s %%d\\n' %s %s $?\n", cmd, head, tail)
+
+	out, rc, err := readUntilMarker(session.shellOut, head+tail)
+	return Results{RC: rc, Stdout: out}, err
+}
+
+// readUntilMarker reads lines up to one consisting of the marker and an
+// exit code, returning the output that preceded it and the code.
+// The marker line is preceded by a newline of its own, which is dropped
+func readUntilMarker(r *bufio.Reader, marker string) (string, int, error) {
+	var out strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return out.String(), 0, fmt.Errorf("shell output ended before the command completed: %w", err)
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(trimmed, marker+" ") {
+			rc, err := strconv.Atoi(trimmed[len(marker)+1:])
+			if err == nil {
+				output := out.String()
+				output = strings.TrimSuffix(output, "\n")
+				output = strings.TrimSuffix(output, "\r")
+				return output, rc, nil
+			}
+		}
+		out.WriteString(line)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// SlogLogger makes a *slog.Logger the server's Logger, logging each
+// message at Info level. As a FieldLogger, what the server logs about
+// a connection carries the connection's details as attributes
+type SlogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger returns a Logger that logs to logger,
+// or to slog.Default() if logger is nil
+func NewSlogLogger(logger *slog.Logger) *SlogLogger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &SlogLogger{logger: logger}
+}
+
+// Log makes this a Logger
+func (l *SlogLogger) Log(args ...interface{}) {
+	l.logger.Info(strings.TrimSuffix(fmt.Sprint(args...), "\n"))
+}
+
+// Logf makes this a Logger
+func (l *SlogLogger) Logf(format string, args ...interface{}) {
+	l.logger.Info(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+}
+
+// With makes this a FieldLogger
+func (l *SlogLogger) With(args ...interface{}) Logger {
+	return &SlogLogger{logger: l.logger.With(args...)}
+}
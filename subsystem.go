@@ -0,0 +1,164 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SubsystemStream is a duplex stream bound to a subsystem
+// (e.g. "sftp" or "netconf") on the remote host
+type SubsystemStream struct {
+	ch   ssh.Channel
+	idle func()
+
+	// set once the channel's requests are done with, when done is closed
+	done      chan struct{}
+	status    int
+	gotStatus bool
+	signal    string
+}
+
+// Subsystem opens a session of its own running the named subsystem,
+// returning a stream that reads from its stdout and writes to its stdin.
+// Its stderr is discarded. The session is opened as a bare channel,
+// as the ssh package only reports the exit status of sessions that
+// run a command or shell. The connection counts as in use until
+// the stream is closed, or the subsystem ends
+func (s *Connection) Subsystem(name string) (*SubsystemStream, error) {
+	idle, err := s.busy()
+	if err != nil {
+		return nil, err
+	}
+	ch, reqs, err := s.client.OpenChannel("session", nil)
+	if err != nil {
+		idle()
+		return nil, err
+	}
+	ok, err := ch.SendRequest("subsystem", true, ssh.Marshal(struct{ Name string }{name}))
+	if err == nil && !ok {
+		err = errors.New("subsystem request refused")
+	}
+	if err != nil {
+		ch.Close()
+		idle()
+		return nil, fmt.Errorf("can't start subsystem %q -- %w", name, err)
+	}
+	st := &SubsystemStream{ch: ch, idle: idle, done: make(chan struct{})}
+	go io.Copy(ioutil.Discard, ch.Stderr())
+	go st.serviceRequests(reqs)
+	return st, nil
+}
+
+// serviceRequests notes the exit status or signal the subsystem ends
+// with, until the channel is closed
+func (st *SubsystemStream) serviceRequests(reqs <-chan *ssh.Request) {
+	defer st.idle()
+	defer close(st.done)
+	for req := range reqs {
+		switch req.Type {
+		case "exit-status":
+			if len(req.Payload) >= 4 {
+				st.status = int(binary.BigEndian.Uint32(req.Payload))
+				st.gotStatus = true
+			}
+		case "exit-signal":
+			var msg struct {
+				Signal     string
+				CoreDumped bool
+				Error      string
+				Lang       string
+			}
+			if err := ssh.Unmarshal(req.Payload, &msg); err == nil {
+				st.signal = msg.Signal
+			}
+		}
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// SubsystemSession is a session running a subsystem, as opened by
+// Connection.SubsystemSession
+type SubsystemSession struct {
+	*ssh.Session
+	done func()
+}
+
+// Close tears down the session, leaving the connection open
+func (ss *SubsystemSession) Close() error {
+	defer ss.done()
+	return ss.Session.Close()
+}
+
+// SubsystemSession opens a session of its own running the named subsystem,
+// for the caller to wire up with its StdinPipe, StdoutPipe and StderrPipe,
+// and to close when done with it, the connection counting as in use until
+// then. The ssh package doesn't count the session as started, so its
+// Stdin, Stdout and Stderr fields go unused.
+// The connection's own session and buffers are left alone, so any number
+// of subsystems, e.g. sftp, can run alongside a shell in that session
+func (s *Connection) SubsystemSession(name string) (*SubsystemSession, error) {
+	done, err := s.busy()
+	if err != nil {
+		return nil, err
+	}
+	session, err := s.client.NewSession()
+	if err != nil {
+		done()
+		return nil, err
+	}
+	if err := session.RequestSubsystem(name); err != nil {
+		session.Close()
+		done()
+		return nil, fmt.Errorf("can't start subsystem %q -- %w", name, err)
+	}
+	return &SubsystemSession{Session: session, done: done}, nil
+}
+
+// Read makes this an io.Reader
+func (st *SubsystemStream) Read(b []byte) (int, error) {
+	return st.ch.Read(b)
+}
+
+// Write makes this an io.Writer
+func (st *SubsystemStream) Write(b []byte) (int, error) {
+	return st.ch.Write(b)
+}
+
+// CloseWrite sends EOF to the subsystem, leaving the stream readable
+func (st *SubsystemStream) CloseWrite() error {
+	return st.ch.CloseWrite()
+}
+
+// Close tears down the subsystem's session, leaving the connection open
+func (st *SubsystemStream) Close() error {
+	defer st.idle()
+	return st.ch.Close()
+}
+
+// Wait waits for the subsystem to exit and returns its exit status.
+// A non-zero status is also returned as a CmdError. Should the subsystem
+// be killed by a signal, or end without a status, it returns -1 with
+// an error saying so, the latter matching ErrExitUnknown
+func (st *SubsystemStream) Wait() (int, error) {
+	<-st.done
+	switch {
+	case st.gotStatus && st.status == 0:
+		return 0, nil
+	case st.gotStatus:
+		return st.status, CmdError{RC: st.status}
+	case st.signal != "":
+		return -1, fmt.Errorf("subsystem killed by signal %s: %w", st.signal, ErrCommandFailed)
+	}
+	return -1, wrap(ErrExitUnknown, errors.New("subsystem ended without an exit status"))
+}
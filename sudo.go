@@ -0,0 +1,103 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RunSudo runs cmd with sudo in a session of its own, on a pty as sudo
+// may insist, giving sudoPassword when sudo prompts for it. Should sudo
+// not need a password, the password isn't sent. Should sudo reject it,
+// the session is closed, rather than wait on sudo to prompt again, and
+// the error is ErrSudoPassword. The pty combines stdout and stderr,
+// so the output is all in Stdout, with the pty's "\r\n"s as "\n"s.
+// The connection's Environment is left out, as sudo would reset it
+func RunSudo(conn *Connection, cmd, sudoPassword string) (Results, error) {
+	done, err := conn.busy()
+	if err != nil {
+		return Results{}, err
+	}
+	defer done()
+	session, err := conn.client.NewSession()
+	if err != nil {
+		return Results{}, err
+	}
+	defer session.Close()
+
+	modes := ssh.TerminalModes{ssh.ECHO: 0}
+	if err := session.RequestPty("xterm", 40, 80, modes); err != nil {
+		return Results{}, fmt.Errorf("request for pseudo terminal failed: %w", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return Results{}, err
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return Results{}, err
+	}
+	// the prompt is made unlikely to turn up in the command's output,
+	// so it's only taken for sudo's
+	w := &sudoWriter{prompt: "__sshclient_sudo_" + hex.EncodeToString(b) + "__"}
+	w.answer = func(prompts int) {
+		if prompts == 1 {
+			fmt.Fprintln(stdin, sudoPassword)
+			return
+		}
+		w.rejected = true
+		session.Close()
+	}
+	session.Stdout = w
+	session.Stderr = w
+
+	err = exitError(session.Run("sudo -S -p " + shellQuote(w.prompt) + " " + cmd))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	out := strings.Replace(w.out.String(), "\r\n", "\n", -1)
+	if w.rejected {
+		return Results{RC: -1, Stdout: out}, ErrSudoPassword
+	}
+	return newResults(err, out, ""), err
+}
+
+// sudoWriter collects the output of sudo, answering its prompts
+// as they turn up, and leaving them out of the output
+type sudoWriter struct {
+	mu       sync.Mutex
+	out      bytes.Buffer
+	prompt   string
+	prompts  int
+	answer   func(prompts int)
+	rejected bool
+}
+
+func (w *sudoWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.out.Write(b)
+	// the prompt may arrive split across writes,
+	// so look for it in all the output so far
+	for {
+		i := bytes.Index(w.out.Bytes(), []byte(w.prompt))
+		if i < 0 {
+			break
+		}
+		rest := append([]byte(nil), w.out.Bytes()[i+len(w.prompt):]...)
+		w.out.Truncate(i)
+		w.out.Write(rest)
+		w.prompts++
+		w.answer(w.prompts)
+	}
+	return len(b), nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+)
+
+// Upload copies the file at localPath to remotePath on the remote host,
+// keeping its mode. It uses sftp, unless the remote host doesn't offer
+// it, in which case scp is used instead. LastTransport reports which
+func (s *Connection) Upload(localPath, remotePath string) error {
+	done, err := s.busy()
+	if err != nil {
+		return err
+	}
+	defer done()
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if err := s.checkSize(localPath, info.Size()); err != nil {
+		return err
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("can't open %q -- %w", localPath, err)
+	}
+	defer f.Close()
+
+	client, sftpErr := s.SFTP()
+	if sftpErr == nil {
+		defer client.Close()
+		s.setTransport(TransportSFTP)
+		if err := client.Upload(f, remotePath, info.Mode()); err != nil {
+			return fmt.Errorf("sftp upload: %w", err)
+		}
+		return nil
+	}
+
+	s.setTransport(TransportSCP)
+	err = s.scpCopy(context.Background(), f, path.Base(remotePath), remotePath, info.Size(), info.Mode())
+	if err != nil {
+		return fmt.Errorf("scp upload, as %v: %w", sftpErr, err)
+	}
+	return nil
+}
+
+// Download copies remotePath on the remote host to localPath, keeping
+// its mode. As with Upload, sftp is used if the remote host offers it,
+// otherwise scp
+func (s *Connection) Download(remotePath, localPath string) error {
+	done, err := s.busy()
+	if err != nil {
+		return err
+	}
+	defer done()
+	client, sftpErr := s.SFTP()
+	if sftpErr != nil {
+		s.setTransport(TransportSCP)
+		if err := s.FetchFile(remotePath, localPath); err != nil {
+			return fmt.Errorf("scp download, as %v: %w", sftpErr, err)
+		}
+		return nil
+	}
+	defer client.Close()
+	s.setTransport(TransportSFTP)
+
+	info, err := client.Stat(remotePath)
+	if err != nil {
+		return fmt.Errorf("sftp download: can't stat %q -- %w", remotePath, err)
+	}
+	f, err := os.Create(localPath)
+	if err != nil {
+		return fmt.Errorf("can't create %q -- %w", localPath, err)
+	}
+	if err := client.Download(remotePath, f); err != nil {
+		f.Close()
+		os.Remove(localPath)
+		return fmt.Errorf("sftp download: %w", err)
+	}
+	if err := f.Chmod(info.Mode().Perm()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 Paul Stuart. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshclient
+
+import (
+	"strconv"
+	"strings"
+)
+
+// parseServerVersion splits an identification banner such as
+// "SSH-2.0-OpenSSH_8.9p1 Ubuntu-3" into its software name ("OpenSSH")
+// and version ("8.9p1"). The Windows port of OpenSSH, which identifies
+// as "OpenSSH_for_Windows_8.1", is taken for OpenSSH
+func parseServerVersion(banner string) (software, version string) {
+	// per RFC 4253, the banner is SSH-protoversion-softwareversion SP comments
+	banner = strings.TrimPrefix(banner, "SSH-")
+	if i := strings.Index(banner, "-"); i >= 0 {
+		banner = banner[i+1:]
+	}
+	if i := strings.IndexByte(banner, ' '); i >= 0 {
+		banner = banner[:i]
+	}
+	// the version follows the last underscore, as names may have their own
+	if i := strings.LastIndexByte(banner, '_'); i >= 0 {
+		return strings.TrimSuffix(banner[:i], "_for_Windows"), banner[i+1:]
+	}
+	return banner, ""
+}
+
+// ServerVersion returns the server's full identification banner,
+// e.g. "SSH-2.0-OpenSSH_8.9p1 Ubuntu-3"
+func (s *Connection) ServerVersion() string {
+	return string(s.client.ServerVersion())
+}
+
+// SessionID returns the identifier of the connection negotiated
+// during the key exchange
+func (s *Connection) SessionID() []byte {
+	return s.client.SessionID()
+}
+
+// ServerImplementation returns the software version from the server's
+// identification banner, e.g. "OpenSSH_8.9p1" or "dropbear_2020.81"
+func (s *Connection) ServerImplementation() string {
+	software, version := parseServerVersion(string(s.client.ServerVersion()))
+	if version == "" {
+		return software
+	}
+	return software + "_" + version
+}
+
+// IsOpenSSH reports whether the remote server is OpenSSH
+func (s *Connection) IsOpenSSH() bool {
+	software, _ := parseServerVersion(string(s.client.ServerVersion()))
+	return software == "OpenSSH"
+}
+
+// ServerVersionAtLeast reports whether the remote server software
+// is at least the given version, e.g. "8.9"
+func (s *Connection) ServerVersionAtLeast(version string) bool {
+	_, v := parseServerVersion(string(s.client.ServerVersion()))
+	return CompareVersions(v, version) >= 0
+}
+
+// CompareVersions compares dotted version strings numerically,
+// returning -1, 0, or 1 if a is less than, equal to, or greater than b.
+// Trailing non-numeric text in a field is ignored, so "8.9p1" equals "8.9"
+func CompareVersions(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = leadingInt(as[i])
+		}
+		if i < len(bs) {
+			y = leadingInt(bs[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// leadingInt returns the value of the leading digits in s
+func leadingInt(s string) int {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	n, _ := strconv.Atoi(s[:i])
+	return n
+}
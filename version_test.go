@@ -0,0 +1,64 @@
+package sshclient
+
+import "testing"
+
+func TestParseServerVersion(t *testing.T) {
+	tests := []struct {
+		banner, software, version string
+	}{
+		{"SSH-2.0-OpenSSH_8.9p1 Ubuntu-3", "OpenSSH", "8.9p1"},
+		{"SSH-2.0-OpenSSH_for_Windows_8.1", "OpenSSH", "8.1"},
+		{"SSH-2.0-dropbear_2020.81", "dropbear", "2020.81"},
+		{"SSH-2.0-Go", "Go", ""},
+		{"SSH-1.99-Cisco-1.25", "Cisco-1.25", ""},
+	}
+	for _, tt := range tests {
+		software, version := parseServerVersion(tt.banner)
+		if software != tt.software || version != tt.version {
+			t.Errorf("%q want: %q %q -- got: %q %q", tt.banner, tt.software, tt.version, software, version)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"8.9p1", "8.9", 0},
+		{"8.9", "9.0", -1},
+		{"9.0", "8.9", 1},
+		{"8.10", "8.9", 1},
+		{"2020.81", "2019.78", 1},
+		{"8", "8.0", 0},
+		{"", "1", -1},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) want: %d -- got: %d", tt.a, tt.b, tt.want, got)
+		}
+	}
+}
+
+func TestLocalServerImplementation(t *testing.T) {
+	host := testServer(t, nil)
+
+	s, err := DialPassword(host, testUsername, testPassword, 1)
+	if err != nil {
+		t.Fatal("ssh connect error:", err)
+	}
+	defer s.Close()
+
+	if impl := s.ServerImplementation(); impl != "Go" {
+		t.Errorf("want: %q -- got: %q", "Go", impl)
+	}
+	if s.IsOpenSSH() {
+		t.Error("Go server reported as OpenSSH")
+	}
+	if v := s.ServerVersion(); v != "SSH-2.0-Go" {
+		t.Errorf("want: %q -- got: %q", "SSH-2.0-Go", v)
+	}
+	if len(s.SessionID()) == 0 {
+		t.Error("no session id")
+	}
+}